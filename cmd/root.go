@@ -56,7 +56,7 @@ func Execute() error {
 	if err != nil {
 		return err
 	}
-	http.IniHttpClient(cnf.BaseUrl)
+	http.IniHttpClient(cnf.BaseUrl, logger.Sugar())
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
 	defer cancel()
 	rootCmd := &cobra.Command{
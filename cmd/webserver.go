@@ -8,45 +8,24 @@ import (
 	"image"
 	"io"
 	"log"
-	"math/rand/v2"
 	"net"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gibgibik/go-ch9329/pkg/ch9329"
 	"github.com/gibgibik/go-lineage2-macros/internal/core"
+	http2 "github.com/gibgibik/go-lineage2-macros/internal/core/http"
+	"github.com/gibgibik/go-lineage2-macros/internal/engine"
 	"github.com/gibgibik/go-lineage2-macros/internal/service"
-	"github.com/gibgibik/go-lineage2-server/pkg/entity"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
 
-type runStackStruct struct {
-	sync.Mutex
-	item    service.ProfileTemplateItem
-	lastRun time.Time
-}
-
-const (
-	stackTypeMain = iota
-	stackTypeSecondary
-)
-
-type stackStruct struct {
-	stackType uint8
-	runMutex  *sync.Mutex
-	stopCh    chan struct{}
-	reloadCh  chan struct{}
-	waitCh    chan struct{}
-	webWaitCh chan struct{}
-	stack     []runStackStruct
-}
-
 var (
 	startResult = make(chan error, 1)
 	upgrader    = websocket.Upgrader{
@@ -57,7 +36,7 @@ var (
 			return true
 		},
 	}
-	runStack           map[uint32]*stackStruct
+	registry           = engine.NewRegistry()
 	messagesStack      []string
 	messagesStackMutex sync.Mutex
 )
@@ -101,30 +80,6 @@ func parseCondition(s string) *Condition {
 	}
 }
 
-func initStacks(pid uint32, r *http.Request, logger *zap.SugaredLogger) error {
-	profileData, err := service.GetProfileData(strings.Trim(r.RequestURI, "/"), logger)
-	if err != nil {
-		return err
-	}
-	if len(runStack[pid].stack) == 0 {
-		for _, val := range profileData.Items {
-			if val.Action == "" {
-				continue
-			}
-			cp := runStack[pid]
-			cp.stack = append(runStack[pid].stack, runStackStruct{
-				item: val,
-			})
-			runStack[pid] = cp
-		}
-
-	}
-	if len(runStack[pid].stack) == 0 {
-		logger.Error("no actions available")
-		return errors.New("no actions available")
-	}
-	return nil
-}
 func createWebServerCommand(logger *zap.SugaredLogger) *cobra.Command {
 	var webServer = &cobra.Command{
 		Use: "web-server",
@@ -201,51 +156,66 @@ func httpServerStart(ctx context.Context, cnf *core.Config, logger *zap.SugaredL
 		Addr:         ":" + cnf.WebServer.Port,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		ErrorLog:     log.New(&core.FwdToZapWriter{logger}, "", 0),
+		ErrorLog:     log.New(&core.FwdToZapWriter{Logger: logger}, "", 0),
 		BaseContext: func(listener net.Listener) context.Context {
 			return context.WithValue(ctx, "logger", logger)
 		},
 	}
+	server := service.NewServerClient(http2.HttpCl)
 	mux := http.NewServeMux() // Create
 	mux.HandleFunc("/ws", wsHandler)
-	mux.HandleFunc("/api/profile/", templateHandler)
+	mux.HandleFunc("/api/profile/", templateHandler(cnf))
 	mux.HandleFunc("/api/start/", startHandler(ctx, cnf))
 	mux.HandleFunc("/api/pause", func(writer http.ResponseWriter, request *http.Request) {
-		var pb pidBody
-		defer request.Body.Close()
-		if err := json.NewDecoder(request.Body).Decode(&pb); err != nil {
-			createRequestError(writer, "Invalid JSON", http.StatusBadRequest)
+		runner, ok := runnerFromBody(writer, request)
+		if !ok {
 			return
 		}
-		if _, ok := runStack[pb.Pid]; !ok {
-			createRequestError(writer, "Invalid PID", http.StatusBadRequest)
-			return
-		}
-		if !runStack[pb.Pid].runMutex.TryLock() {
-			runStack[pb.Pid].webWaitCh <- struct{}{}
+		if runner.Paused() {
+			runner.Resume()
 		} else {
-			runStack[pb.Pid].runMutex.Unlock()
+			runner.Pause()
 		}
 	})
-	mux.HandleFunc("/api/stop", func(writer http.ResponseWriter, request *http.Request) {
-		var pb pidBody
-		defer request.Body.Close()
-		if err := json.NewDecoder(request.Body).Decode(&pb); err != nil {
-			createRequestError(writer, "Invalid JSON", http.StatusBadRequest)
+	watchdog := engine.NewWatchdog(engine.SystemClock{}, engine.WatchdogSettings{
+		StuckAfter:   time.Duration(cnf.Watchdog.StuckAfterMilliseconds) * time.Millisecond,
+		RecoverAfter: time.Duration(cnf.Watchdog.RecoverAfterMilliseconds) * time.Millisecond,
+	}, logger)
+	go watchdog.Run(ctx, registry.Runners)
+	mux.HandleFunc("/api/watchdog", func(writer http.ResponseWriter, request *http.Request) {
+		res, _ := json.Marshal(watchdog.Stuck())
+		writer.Write(res)
+	})
+	// /api/recover force stops a stuck runner and releases the foreground it holds
+	mux.HandleFunc("/api/recover", func(writer http.ResponseWriter, request *http.Request) {
+		runner, ok := runnerFromBody(writer, request)
+		if !ok {
 			return
 		}
-		if _, ok := runStack[pb.Pid]; !ok {
-			createRequestError(writer, "Invalid PID", http.StatusBadRequest)
-			return
+		if !runner.ForceStop(time.Second * 5) {
+			createRequestError(writer, "runner didn't stop, its foreground was released", http.StatusAccepted)
 		}
-		if !runStack[pb.Pid].runMutex.TryLock() {
-			runStack[pb.Pid].stopCh <- struct{}{}
-		} else {
-			runStack[pb.Pid].runMutex.Unlock()
+	})
+	mux.HandleFunc("/api/stop", func(writer http.ResponseWriter, request *http.Request) {
+		runner, ok := runnerFromBody(writer, request)
+		if !ok {
+			return
 		}
+		runner.Stop()
+	})
+	mux.HandleFunc("/api/status", func(writer http.ResponseWriter, request *http.Request) {
+		res, _ := json.Marshal(registry.Statuses())
+		writer.Write(res)
+	})
+	mux.HandleFunc("/api/server", func(writer http.ResponseWriter, request *http.Request) {
+		res, _ := json.Marshal(map[string]string{"state": http2.HttpCl.ServerState()})
+		writer.Write(res)
 	})
 	mux.HandleFunc("/api/init", func(writer http.ResponseWriter, request *http.Request) {
-		initData, _ := service.Init()
+		initData, err := server.Init(request.Context())
+		if err != nil {
+			logger.Error("server init error: " + err.Error())
+		}
 		response := struct {
 			RunningMacrosState map[uint32]bool `json:"runningMacrosState"`
 			ProfilesList       []string        `json:"profilesList"`
@@ -255,36 +225,31 @@ func httpServerStart(ctx context.Context, cnf *core.Config, logger *zap.SugaredL
 			ProfilesList:       service.GetProfilesList(),
 			PidsData:           initData.PidsData,
 		}
-		var minPid uint32
-		for pid := range response.PidsData {
-			if minPid == 0 || minPid > pid {
-				minPid = pid
-			}
+		timing, err := engine.NewTiming(cnf.Timing)
+		if err != nil {
+			createRequestError(writer, "timing config: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		if len(runStack) == 0 {
-			runStack = make(map[uint32]*stackStruct, 0)
-			for pid := range response.PidsData {
-				str := stackStruct{runMutex: &sync.Mutex{}, stack: []runStackStruct{}, stopCh: make(chan struct{}), reloadCh: make(chan struct{}), waitCh: make(chan struct{}), webWaitCh: make(chan struct{})}
-				if minPid == pid {
-					str.stackType = stackTypeMain
-				} else {
-					str.stackType = stackTypeSecondary
-				}
-				runStack[pid] = &str
-			}
-		} else {
-			for pid := range runStack {
-				if !runStack[pid].runMutex.TryLock() {
-					response.RunningMacrosState[pid] = true
-				} else {
-					response.RunningMacrosState[pid] = false
-					runStack[pid].runMutex.Unlock()
-				}
-			}
+		registry.Init(func() []engine.RegistryEntry {
+			return newRegistryEntries(cnf, server, response.PidsData, timing)
+		})
+		for _, runner := range registry.Runners() {
+			response.RunningMacrosState[runner.Pid()] = runner.Running()
 		}
 		res, _ := json.Marshal(response)
 		writer.Write(res)
 	})
+	mux.HandleFunc("/api/record/", recordHandler(cnf))
+	mux.HandleFunc("/api/device", func(writer http.ResponseWriter, request *http.Request) {
+		statuses := service.GetControlStatuses()
+		for _, device := range append([]core.Device{{Name: core.DefaultDevice}}, cnf.Devices...) {
+			if _, ok := statuses[device.Name]; !ok {
+				statuses[device.Name] = service.DeviceStatus{State: service.DeviceDisconnected}
+			}
+		}
+		res, _ := json.Marshal(statuses)
+		writer.Write(res)
+	})
 	mux.HandleFunc("/api/stats", func(writer http.ResponseWriter, request *http.Request) {
 		if request.Method != http.MethodPost {
 			createRequestError(writer, "Invalid Method", http.StatusMethodNotAllowed)
@@ -295,9 +260,7 @@ func httpServerStart(ctx context.Context, cnf *core.Config, logger *zap.SugaredL
 			logger.Error("stat body read error ", err.Error())
 			return
 		}
-		service.PlayerStatsMutex.Lock()
-		defer service.PlayerStatsMutex.Unlock()
-		err = json.Unmarshal(body, &service.PlayerStats)
+		err = service.UpdatePlayerStats(body, time.Now())
 		if err != nil {
 			logger.Error("stat json unmarshal error ", err.Error())
 			return
@@ -327,308 +290,156 @@ func startHandler(ctx context.Context, cnf *core.Config) func(w http.ResponseWri
 		}
 
 		pid := body.Pid
-		if _, ok := runStack[pid]; !ok {
+		entry, ok := registry.Get(pid)
+		if !ok {
 			createRequestError(w, "Invalid PID", http.StatusBadRequest)
 			return
 		}
 		logger := r.Context().Value("logger").(*zap.SugaredLogger).With("pid", pid)
-		if !runStack[pid].runMutex.TryLock() {
-			runStack[pid].waitCh <- struct{}{}
-			logger.Error("already running")
-			createRequestError(w, "already running", http.StatusServiceUnavailable)
+		profileName, err := service.GetProfileName(strings.Trim(r.RequestURI, "/"), logger)
+		if err != nil {
+			createRequestError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		logger.Info("starting macros")
-		controlCl, controlErr := service.GetControl(cnf.Control)
+		var control engine.Control
+		device := entry.Device
+		deviceCnf, _ := cnf.Device(device)
+		controlCl, controlErr := service.GetDeviceControl(device, deviceCnf, r.Context().Value("logger").(*zap.SugaredLogger))
 		if controlErr != nil {
-			logger.Errorf("control create failed: %v", controlErr)
+			logger.Errorf("control %s create failed: %v", device, controlErr)
 		} else {
-			//defer controlCl.cl.Port.Close()
+			control = controlCl
 		}
-		var anotherPid uint32
-		for k := range runStack {
-			if k != pid {
-				anotherPid = k
-				break
+		if err := entry.Runner.Start(ctx, profileName, control, entry.Arbiter, logger); err != nil {
+			logger.Error(err.Error())
+			createRequestError(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		logger.Info("starting macros")
+	}
+}
+
+// recordHandler starts recording the input sent to the device of the window into the file named in the body
+// on /api/record/start/<pid> and finishes it on /api/record/stop/<pid>.
+func recordHandler(cnf *core.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			createRequestError(w, "Invalid Method", http.StatusMethodNotAllowed)
+			return
+		}
+		action, pidStr, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/record/"), "/")
+		pid, err := strconv.ParseUint(pidStr, 10, 32)
+		if err != nil {
+			createRequestError(w, "Invalid PID", http.StatusBadRequest)
+			return
+		}
+		entry, ok := registry.Get(uint32(pid))
+		if !ok {
+			createRequestError(w, "Invalid PID", http.StatusBadRequest)
+			return
+		}
+		logger := r.Context().Value("logger").(*zap.SugaredLogger).With("pid", pid)
+		deviceCnf, _ := cnf.Device(entry.Device)
+		if _, err := service.GetDeviceControl(entry.Device, deviceCnf, logger); err != nil {
+			createRequestError(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		recorder := service.GetRecorder(entry.Device)
+		if recorder == nil {
+			createRequestError(w, "device "+entry.Device+" can't be recorded", http.StatusServiceUnavailable)
+			return
+		}
+		switch action {
+		case "start":
+			var body struct {
+				Name string `json:"name"`
+			}
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				createRequestError(w, "Invalid JSON", http.StatusBadRequest)
+				return
 			}
+			if err := recorder.Start(body.Name); err != nil {
+				createRequestError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("recording " + body.Name + " started")
+		case "stop":
+			name, err := recorder.Stop()
+			if err != nil {
+				createRequestError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("recording " + name + " saved")
+		default:
+			createRequestError(w, "Not Found", http.StatusNotFound)
 		}
-		go func() {
-			defer runStack[pid].runMutex.Unlock()
-			for {
-				select {
-				case <-ctx.Done():
-					runStack[pid].stopCh <- struct{}{}
-				case <-runStack[pid].reloadCh:
-					cp := runStack[pid]
-					cp.stack = []runStackStruct{}
-					runStack[pid] = cp
-					logger.Info("reloaded")
-				case <-runStack[pid].stopCh:
-					logger.Info("macros stopped")
-					cp := runStack[pid]
-					cp.stack = []runStackStruct{}
-					runStack[pid] = cp
-					return
-				case <-runStack[pid].webWaitCh:
-					logger.Info("pause from web context")
-					<-runStack[pid].webWaitCh
-					logger.Info("continue from web context")
-				case <-runStack[pid].waitCh:
-					logger.Info("wait start")
-					controlCl.MouseActionAbsolute(ch9329.MousePressLeft, image.Point{960, 560}, 0)
-					time.Sleep(time.Millisecond * 50)
-					controlCl.MouseAbsoluteEnd()
-					if !runStack[anotherPid].runMutex.TryLock() {
-						runStack[anotherPid].waitCh <- struct{}{}
-					} else {
-						runStack[anotherPid].runMutex.Unlock()
-					}
-					<-runStack[pid].waitCh
-					logger.Info("wait end")
-					continue
-				default:
-					err := initStacks(body.Pid, r, logger)
-					if err != nil {
-						logger.Error("init stacks error: " + err.Error())
-						sendMessage("init stacks error: " + err.Error())
-						return
-					}
-					var i int
-					var checksPassed bool
-					var windowSwitched = false
-					if runStack[pid].stackType == stackTypeMain {
-						_ = switchWindow(pid, controlCl, logger) //switching window
-					}
-					for {
-						if i >= len(runStack[pid].stack) {
-							break
-						}
-						var playerStat *entity.PlayerStat
-						service.PlayerStatsMutex.Lock()
-						if val, ok := service.PlayerStats.Player[pid]; ok {
-							playerStat = &val
-						}
-						service.PlayerStatsMutex.Unlock()
-						runAction := &runStack[pid].stack[i]
-						if runAction.item.Action == service.ActionStop {
-							if runAction.lastRun.IsZero() {
-								runStack[pid].stack[i].lastRun = time.Now()
-							} else if runAction.item.PeriodMilliseconds > 0 && (runAction.lastRun.UnixMilli()+int64(runAction.item.PeriodMilliseconds)) < time.Now().UnixMilli() {
-								if playerStat.Target.HpPercent == 0 {
-									checksPassed = makeChecks(runStack, pid, checksPassed, controlCl, logger)
-									if !checksPassed {
-										logger.Error("makecheck failed")
-									} else {
-										if !windowSwitched && runStack[pid].stackType == stackTypeSecondary {
-											if !runStack[anotherPid].runMutex.TryLock() {
-												runStack[anotherPid].waitCh <- struct{}{}
-												<-runStack[pid].waitCh
-											} else {
-												runStack[anotherPid].runMutex.Unlock()
-											}
-											_ = switchWindow(pid, controlCl, logger)
-											windowSwitched = true
-										}
-										//logger.Info("press ", runAction.item.Binding)
-										controlCl.SendKey(0, runAction.item.Binding)
-										time.Sleep(time.Millisecond * 50)
-										controlCl.EndKey()
-										if runAction.item.DelayMilliseconds > 0 {
-											time.Sleep(time.Millisecond * time.Duration(runAction.item.DelayMilliseconds))
-										}
-									}
-									time.Sleep(time.Second * 10)
-									runStack[pid].stopCh <- struct{}{}
-									logger.Debug("macros stopped due to stop!!!")
-								}
-							}
-							i++
-							continue
-						}
-						if runAction.item.PeriodMilliseconds > 0 && runAction.lastRun.UnixMilli() > (time.Now().UnixMilli()-runAction.item.PeriodMilliseconds) {
-							i++
-							continue
-						}
-						service.PlayerStatsMutex.Lock()
-						if ok, err := service.CheckCondition(runAction.item.ConditionsCombinator, runAction.item.Conditions, playerStat, service.PlayerStats.Party, logger); !ok {
-							service.PlayerStatsMutex.Unlock()
-							i++
-							if err != nil {
-								logger.Error("check condition error: " + err.Error())
-							}
-							continue
-						} else {
-							service.PlayerStatsMutex.Unlock()
-						}
-						if runAction.item.Action == service.ActionAITargetNext {
-							if runStack[pid].stackType == stackTypeSecondary {
-								logger.Error("ainexttarget isn't supported by the bot yet")
-							} else {
-								bounds, err := service.FindBounds(logger)
-								if err != nil {
-									logger.Error("find bounds error: " + err.Error())
-									i++
-									continue
-								} else {
-									if controlErr == nil {
-										controlCl.SendKey(ch9329.ModLeftShift, "z") //stay
-										time.Sleep(time.Millisecond * 50)
-										for _, bound := range bounds.Boxes {
-											if playerStat.Target.HpPercent > 0 {
-												break
-											}
-											controlCl.MouseActionAbsolute(ch9329.MousePressLeft, image.Point{
-												X: int((bound[2]-bound[0])/2) + bound[0],
-												Y: bound[1] + 30,
-											}, 0)
-											controlCl.MouseAbsoluteEnd()
-											time.Sleep(time.Millisecond * 50)
-											if currentTarget, _ := service.GetCurrentTarget(logger); currentTarget != "" {
-												logger.Info("target is " + currentTarget)
-												if currentTarget == "Gibik" || (currentTarget != "Cave Servant" && currentTarget != "Shackle") {
-													//controlCl.SendKey(0, "esc")
-													time.Sleep(time.Millisecond * 50)
-												} else {
-													break
-												}
-											}
-											//time.Sleep(time.Millisecond * time.Duration(randNum(400, 500)))
-										}
-										if playerStat.Target.HpPercent == 0 {
-											controlCl.MouseActionAbsolute(ch9329.MousePressRight, image.Pt(480, 320), 0)
-											controlCl.MouseActionAbsolute(ch9329.MousePressRight, image.Pt(580, 320), 0)
-											controlCl.MouseAbsoluteEnd()
-										}
-										controlCl.EndKey()
-									}
-								}
-								runStack[pid].stack[i].lastRun = time.Now()
-							}
-							i++
-							continue
-						}
-						if runAction.item.Action == service.ActionAssistPartyMember {
-							checksPassed = makeChecks(runStack, pid, checksPassed, controlCl, logger)
-							if !checksPassed {
-								logger.Error("makecheck failed")
-							} else {
-								if point, ok := service.AssistPartyMemberMap[runAction.item.Additional]; ok {
-									if !windowSwitched && runStack[pid].stackType == stackTypeSecondary {
-										if !runStack[anotherPid].runMutex.TryLock() {
-											runStack[anotherPid].waitCh <- struct{}{}
-											<-runStack[pid].waitCh
-										} else {
-											runStack[anotherPid].runMutex.Unlock()
-										}
-										windowSwitched = true
-										_ = switchWindow(pid, controlCl, logger)
-									}
-									//logger.Info("press ", runAction.item.Binding)
-									controlCl.MouseActionAbsolute(ch9329.MousePressRight, point, 0)
-									controlCl.MouseAbsoluteEnd()
-									if runAction.item.DelayMilliseconds > 0 {
-										time.Sleep(time.Millisecond * time.Duration(runAction.item.DelayMilliseconds))
-									}
-									runStack[pid].stack[i].lastRun = time.Now()
-									//@todo need delay?
-								} else {
-									logger.Error("wrong additional for assist party member: " + runAction.item.Additional)
-								}
-							}
-							i++
-							time.Sleep(time.Millisecond * time.Duration(randNum(50, 100)))
-							continue
-						}
+	}
+}
 
-						if controlErr == nil {
-							checksPassed = makeChecks(runStack, pid, checksPassed, controlCl, logger)
-							if !checksPassed {
-								logger.Error("makecheck failed")
-							} else {
-								if runAction.item.Action == service.ActionAttack {
-									if currentTarget, _ := service.GetCurrentTarget(logger); currentTarget != "" {
-										logger.Info("target is " + currentTarget)
-										if currentTarget == "Gibik" || (currentTarget != "Cave Servant" && currentTarget != "Shackle") {
-											controlCl.SendKey(0, "esc")
-											time.Sleep(time.Millisecond * 50)
-											controlCl.EndKey()
-											time.Sleep(time.Millisecond * 50)
-											i++
-											continue
-										}
-									}
-								}
-								if !windowSwitched && runStack[pid].stackType == stackTypeSecondary {
-									if !runStack[anotherPid].runMutex.TryLock() {
-										runStack[anotherPid].waitCh <- struct{}{}
-										<-runStack[pid].waitCh
-									} else {
-										runStack[anotherPid].runMutex.Unlock()
+// newRegistryEntries creates a runner for every PID. The runners sharing a device get its arbiter,
+// the lowest PID of the device is the main one.
+func newRegistryEntries(cnf *core.Config, server service.ServerClient, pidsData map[uint32]string, timing engine.Timing) []engine.RegistryEntry {
+	devices := make(map[uint32]string, len(pidsData))
+	devicePids := make(map[string][]uint32)
+	for pid, character := range pidsData {
+		device := cnf.DeviceFor(pid, character)
+		devices[pid] = device
+		devicePids[device] = append(devicePids[device], pid)
+	}
+	arbiters := make(map[string]*engine.Arbiter, len(devicePids))
+	for device := range devicePids {
+		arbiters[device] = engine.NewArbiter(engine.SystemClock{}, engine.ArbiterSettings{
+			AcquireTimeout: time.Duration(cnf.Foreground.AcquireTimeoutMilliseconds) * time.Millisecond,
+			MaxHold:        time.Duration(cnf.Foreground.MaxHoldMilliseconds) * time.Millisecond,
+			Aging:          time.Duration(cnf.Foreground.AgingMilliseconds) * time.Millisecond,
+		})
+	}
+	characters := make([]string, 0, len(pidsData))
+	for _, character := range pidsData {
+		characters = append(characters, character)
+	}
+	entries := make([]engine.RegistryEntry, 0, len(pidsData))
+	for pid, device := range devices {
+		pids := devicePids[device]
+		var runnerType uint8 = engine.TypeSecondary
+		arbiter := arbiters[device]
+		switch {
+		case device != core.DefaultDevice && len(pids) == 1:
+			runnerType = engine.TypeDedicated
+			arbiter = nil
+		case slices.Min(pids) == pid:
+			runnerType = engine.TypeMain
+		}
+		deviceCnf, _ := cnf.Device(device)
+		entries = append(entries, engine.RegistryEntry{
+			Runner: engine.NewRunner(pid, runnerType, service.PushedStats{}, server, engine.SystemClock{}, engine.Settings{
+				StatsMaxAge: time.Duration(cnf.Stats.MaxAgeMilliseconds) * time.Millisecond,
+				Timing:      timing,
+				Screen:      service.ScreenRect(deviceCnf.Resolution),
+				Characters:  characters,
+			}),
+			Device:  device,
+			Arbiter: arbiter,
+		})
+	}
+	return entries
+}
 
-									}
-									windowSwitched = true
-									_ = switchWindow(pid, controlCl, logger)
-								}
-								//logger.Info("press ", runAction.item.Binding)
-								controlCl.SendKey(0, runAction.item.Binding)
-								time.Sleep(time.Millisecond * 50)
-								controlCl.EndKey()
-								if runAction.item.DelayMilliseconds > 0 {
-									time.Sleep(time.Millisecond * time.Duration(runAction.item.DelayMilliseconds))
-								}
-							}
-						}
-						if runAction.item.Action == service.ActionUnstuck {
-							checksPassed = makeChecks(runStack, pid, checksPassed, controlCl, logger)
-							if !checksPassed {
-								logger.Error("makecheck failed")
-							} else {
-								if !windowSwitched && runStack[pid].stackType == stackTypeSecondary {
-									if !runStack[anotherPid].runMutex.TryLock() {
-										runStack[anotherPid].waitCh <- struct{}{}
-										<-runStack[pid].waitCh
-									} else {
-										runStack[anotherPid].runMutex.Unlock()
-									}
-									windowSwitched = true
-									_ = switchWindow(pid, controlCl, logger)
-								}
-								//logger.Info("press ", runAction.item.Binding)
-								controlCl.MouseActionAbsolute(ch9329.MousePressLeft, image.Point{960, 540 + 300}, 0)
-								time.Sleep(time.Millisecond * 50)
-								controlCl.MouseAbsoluteEnd()
-								time.Sleep(time.Second * 3)
-								controlCl.SendKey(0, runAction.item.Binding)
-								time.Sleep(time.Millisecond * 50)
-								controlCl.EndKey()
-								time.Sleep(time.Millisecond * 50)
-								controlCl.SendKey(0, "esc")
-								time.Sleep(time.Millisecond * 50)
-								controlCl.EndKey()
-								if runAction.item.DelayMilliseconds > 0 {
-									time.Sleep(time.Millisecond * time.Duration(runAction.item.DelayMilliseconds))
-								}
-							}
-						}
-						runStack[pid].stack[i].lastRun = time.Now()
-						//message := fmt.Sprintf("%s %s <span style='color:red'>Target HP: [%.2f%%]</span>", runAction.item.Action, runAction.item.Binding, service.PlayerStats.Target.HpPercent)
-						//logger.Info(message)
-						i++
-						time.Sleep(time.Millisecond * time.Duration(randNum(50, 100)))
-					}
-					if windowSwitched {
-						windowSwitched = false
-						_ = switchWindow(anotherPid, controlCl, logger)
-						runStack[anotherPid].waitCh <- struct{}{}
-					}
-					//logger.Info("end interation")
-					//run stack
-					time.Sleep(time.Millisecond * time.Duration(randNum(200, 300)))
-					//time.Sleep(time.Second)
-				}
-			}
-		}()
+// runnerFromBody finds the runner of the PID posted in the body, it responds with an error if there is none.
+func runnerFromBody(w http.ResponseWriter, r *http.Request) (*engine.Runner, bool) {
+	var pb pidBody
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&pb); err != nil {
+		createRequestError(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, false
+	}
+	entry, ok := registry.Get(pb.Pid)
+	if !ok {
+		createRequestError(w, "Invalid PID", http.StatusBadRequest)
+		return nil, false
 	}
+	return entry.Runner, true
 }
 
 func sendMessage(message string) {
@@ -637,34 +448,37 @@ func sendMessage(message string) {
 	messagesStackMutex.Unlock()
 }
 
-func randNum(min int, max int) int {
-	return rand.IntN(max-min) + min
-}
-
-func templateHandler(w http.ResponseWriter, r *http.Request) {
-	logger := r.Context().Value("logger").(*zap.SugaredLogger)
-	if r.Method == "GET" {
-		getTemplateHandler(w, r, logger)
-		return
-	}
-	if r.Method == "POST" {
-		postTemplateHandler(w, r, logger)
-		return
+func templateHandler(cnf *core.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value("logger").(*zap.SugaredLogger)
+		if r.Method == "GET" {
+			getTemplateHandler(w, r, logger)
+			return
+		}
+		if r.Method == "POST" {
+			postTemplateHandler(w, r, cnf, logger)
+			return
+		}
 	}
 }
 
-func postTemplateHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger) {
-	err := service.SaveProfileData(r.Body, logger)
+func postTemplateHandler(w http.ResponseWriter, r *http.Request, cnf *core.Config, logger *zap.SugaredLogger) {
+	err := service.SaveProfileData(r.Body, func(device string) (image.Rectangle, error) {
+		if device == "" {
+			device = core.DefaultDevice
+		}
+		deviceCnf, ok := cnf.Device(device)
+		if !ok {
+			return image.Rectangle{}, fmt.Errorf("unknown device: %s", device)
+		}
+		return service.ScreenRect(deviceCnf.Resolution), nil
+	}, logger)
 	if err != nil {
 		createRequestError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	for k := range runStack {
-		if !runStack[k].runMutex.TryLock() {
-			runStack[k].reloadCh <- struct{}{}
-		} else {
-			runStack[k].runMutex.Unlock()
-		}
+	for _, runner := range registry.Runners() {
+		runner.Reload()
 	}
 }
 func getTemplateHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger) {
@@ -681,54 +495,3 @@ func createRequestError(w http.ResponseWriter, err string, code int) {
 	w.WriteHeader(code)
 	_, _ = w.Write([]byte(err))
 }
-
-func makeChecks(runStack map[uint32]*stackStruct, pid uint32, checksPassed bool, controlCl *service.Control, logger *zap.SugaredLogger) bool {
-	if controlCl == nil {
-		logger.Error("control cl is nil")
-		return false
-	}
-	if checksPassed {
-		return true
-	}
-	return true
-	//if runStack[pid].stackType == stackTypeSecondary {
-	//	for k := range runStack {
-	//		if k != pid {
-	//			runStack[k].waitCh <- struct{}{}
-	//			break
-	//		}
-	//	}
-	//	<-runStack[pid].waitCh //get control
-	//	return switchWindow(pid, controlCl, logger)
-	//} else {
-	//	return true
-	//}
-}
-
-func switchWindow(pid uint32, controlCl *service.Control, logger *zap.SugaredLogger) bool {
-	curPid, err := service.GetForegroundWindowPid()
-	if err != nil {
-		logger.Errorf("get foreground window failed: %v", err)
-		return false
-	}
-	if curPid == 0 || curPid == pid {
-		return true
-	}
-	if controlCl != nil {
-		controlCl.SendKey(0, "\\")
-		time.Sleep(time.Millisecond * 50)
-		controlCl.EndKey()
-		time.Sleep(time.Millisecond * 200)
-	}
-	curPid, err = service.GetForegroundWindowPid()
-	if err != nil {
-		logger.Errorf("get foreground window failed: %v", err)
-		return false
-	}
-	if curPid != pid {
-		logger.Errorf("alt tab failed, current pid is %d, window is %d", curPid, pid)
-		return false
-	}
-
-	return true
-}
@@ -1,24 +1,116 @@
 package core
 
 import (
+	"fmt"
+	"slices"
+	"strings"
+
 	"github.com/spf13/viper"
 )
 
+// DefaultDevice is the name of the device configured in the control section.
+const DefaultDevice = "default"
+
 type Web struct {
 	Port string
 }
 type Control struct {
+	// Driver is "ch9329" for the USB HID adapter or "recording" to only write the input trace
+	Driver     string
 	Port       string
-	BaudRate   int   `mapstructure:"baud_rate"`
-	Resolution []int `mapstructure:"resolution"`
+	BaudRate   int    `mapstructure:"baud_rate"`
+	Resolution []int  `mapstructure:"resolution"`
+	TraceFile  string `mapstructure:"trace_file"`
+}
+type Stats struct {
+	// runners pause when the stats of their PID are older than this, 0 disables the check
+	MaxAgeMilliseconds int `mapstructure:"max_age_milliseconds"`
+}
+
+// Foreground tunes how the runners sharing a device take turns, 0 disables a limit
+type Foreground struct {
+	AcquireTimeoutMilliseconds int `mapstructure:"acquire_timeout_milliseconds"`
+	MaxHoldMilliseconds        int `mapstructure:"max_hold_milliseconds"`
+	AgingMilliseconds          int `mapstructure:"aging_milliseconds"`
+}
+
+// Watchdog reports the runners making no progress and force stops them, 0 disables it
+type Watchdog struct {
+	StuckAfterMilliseconds   int `mapstructure:"stuck_after_milliseconds"`
+	RecoverAfterMilliseconds int `mapstructure:"recover_after_milliseconds"`
+}
+
+// Device is an additional control device, the runners of the listed PIDs or character names
+// drive it instead of the default one.
+type Device struct {
+	Name       string
+	Control    `mapstructure:",squash"`
+	Pids       []uint32
+	Characters []string
+}
+
+// Timing waits are in milliseconds, [min, max] for a random duration or a single fixed value
+type Timing struct {
+	// Seed makes the random durations reproducible, 0 picks a random one
+	Seed  int64
+	Waits map[string][]int
+	// Actions override Waits for a single action, e.g. "/pickup": {"step": [100, 150]}
+	Actions map[string]map[string][]int
 }
 type Config struct {
-	WebServer Web    `mapstructure:"web"`
-	InitUrl   string `mapstructure:"init_url"`
-	BaseUrl   string `mapstructure:"base_url"`
+	WebServer  Web        `mapstructure:"web"`
+	InitUrl    string     `mapstructure:"init_url"`
+	BaseUrl    string     `mapstructure:"base_url"`
+	Stats      Stats      `mapstructure:"stats"`
+	Timing     Timing     `mapstructure:"timing"`
+	Foreground Foreground `mapstructure:"foreground"`
+	Watchdog   Watchdog   `mapstructure:"watchdog"`
+	Devices    []Device   `mapstructure:"devices"`
 	Control
 }
 
+// DeviceFor returns the name of the device driving the PID or the character.
+func (c *Config) DeviceFor(pid uint32, character string) string {
+	for _, device := range c.Devices {
+		if slices.Contains(device.Pids, pid) {
+			return device.Name
+		}
+		for _, name := range device.Characters {
+			if character != "" && strings.EqualFold(name, character) {
+				return device.Name
+			}
+		}
+	}
+	return DefaultDevice
+}
+
+// Device returns the settings of the named device.
+func (c *Config) Device(name string) (Control, bool) {
+	if name == DefaultDevice {
+		return c.Control, true
+	}
+	for _, device := range c.Devices {
+		if device.Name == name {
+			return device.Control, true
+		}
+	}
+	return Control{}, false
+}
+
+func (c *Config) validateDevices() error {
+	names := map[string]bool{DefaultDevice: true}
+	for _, device := range c.Devices {
+		if device.Name == "" {
+			return fmt.Errorf("device name is required")
+		}
+		if names[device.Name] {
+			return fmt.Errorf("duplicate device name: %s", device.Name)
+		}
+		names[device.Name] = true
+	}
+	return nil
+}
+
 func InitConfig() (*Config, error) {
 	viper.SetConfigFile("configs/main.yaml")
 	if err := viper.ReadInConfig(); err != nil {
@@ -36,6 +128,9 @@ func InitConfig() (*Config, error) {
 	if err := viper.Unmarshal(config); err != nil {
 		return nil, err
 	}
+	if err := config.validateDevices(); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+var ErrCircuitOpen = errors.New("server down, circuit breaker is open")
+
+// CircuitBreaker fails the requests fast once the server failed several requests in a row.
+// After the cooldown a single probe request is let through, its success closes the circuit again.
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a request may be sent, it returns ErrCircuitOpen if not.
+func (b *CircuitBreaker) Allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Success records a successful request, it reports whether the circuit was open.
+func (b *CircuitBreaker) Success() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	recovered := b.state != CircuitClosed
+	b.state = CircuitClosed
+	b.failures = 0
+	b.probing = false
+	return recovered
+}
+
+// Failure records a failed request, it reports whether the circuit has just opened.
+func (b *CircuitBreaker) Failure() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == CircuitHalfOpen {
+		b.state = CircuitOpen
+		b.openedAt = b.now()
+		return false
+	}
+	if b.state == CircuitClosed && b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = b.now()
+		return true
+	}
+	return false
+}
+
+// Cancel records a request abandoned by the caller, it doesn't tell anything about the server.
+func (b *CircuitBreaker) Cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
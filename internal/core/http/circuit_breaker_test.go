@@ -0,0 +1,172 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestBreaker() (*CircuitBreaker, *time.Time) {
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreaker(2, 5*time.Second)
+	breaker.now = func() time.Time { return now }
+	return breaker, &now
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	breaker, _ := newTestBreaker()
+	if breaker.Failure() || breaker.State() != CircuitClosed {
+		t.Fatalf("state after one failure = %s, want closed", breaker.State())
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("Allow below the threshold = %v", err)
+	}
+	if !breaker.Failure() || breaker.State() != CircuitOpen {
+		t.Fatalf("state after two failures = %s, want open", breaker.State())
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow when open = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	breaker, now := newTestBreaker()
+	breaker.Failure()
+	breaker.Failure()
+
+	*now = now.Add(4 * time.Second)
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow before the cooldown = %v, want ErrCircuitOpen", err)
+	}
+	*now = now.Add(time.Second)
+	if err := breaker.Allow(); err != nil || breaker.State() != CircuitHalfOpen {
+		t.Fatalf("Allow after the cooldown = %v in %s, want a probe in half-open", err, breaker.State())
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second Allow while probing = %v, want ErrCircuitOpen", err)
+	}
+
+	// a failed probe opens the circuit for another cooldown
+	if breaker.Failure() || breaker.State() != CircuitOpen {
+		t.Fatalf("state after a failed probe = %s, want open", breaker.State())
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow right after a failed probe = %v, want ErrCircuitOpen", err)
+	}
+
+	*now = now.Add(5 * time.Second)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("Allow after the second cooldown = %v", err)
+	}
+	if !breaker.Success() || breaker.State() != CircuitClosed {
+		t.Fatalf("state after a successful probe = %s, want closed", breaker.State())
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("Allow when closed again = %v", err)
+	}
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	breaker, now := newTestBreaker()
+	breaker.Failure()
+	breaker.Failure()
+	*now = now.Add(5 * time.Second)
+	if err := breaker.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	breaker.Cancel()
+	if err := breaker.Allow(); err != nil || breaker.State() != CircuitHalfOpen {
+		t.Fatalf("Allow after a cancelled probe = %v in %s, want another probe", err, breaker.State())
+	}
+}
+
+func TestRawRequestStopsRetryingAtDeadline(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	IniHttpClient(server.URL, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := HttpCl.RawRequest(ctx, "/", http.MethodGet, nil)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusInternalServerError {
+		t.Fatalf("RawRequest error = %v, want the last 500 status", err)
+	}
+	if elapsed := time.Since(start); elapsed > 120*time.Millisecond {
+		t.Errorf("RawRequest took %s, past the 120ms deadline", elapsed)
+	}
+	if attempts >= maxAttempts {
+		t.Errorf("RawRequest made %d attempts, the backoff should have run past the deadline", attempts)
+	}
+}
+
+// failFast makes a failing request give up after its first attempt, the backoff is past the deadline.
+func failFast(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestRawRequestBreakerPerEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	IniHttpClient(server.URL, zap.NewNop().Sugar())
+
+	for range breakerThreshold {
+		if _, err := HttpCl.RawRequest(failFast(t), "/broken", http.MethodGet, nil); err == nil {
+			t.Fatal("request to the broken endpoint succeeded")
+		}
+	}
+	if state := HttpCl.ServerState(); state != CircuitOpen {
+		t.Fatalf("server state = %s, want open", state)
+	}
+	if _, err := HttpCl.RawRequest(context.Background(), "/broken?page=2", http.MethodGet, nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("request to the broken endpoint = %v, want ErrCircuitOpen", err)
+	}
+	if _, err := HttpCl.RawRequest(context.Background(), "/working", http.MethodGet, nil); err != nil {
+		t.Errorf("request to another endpoint = %v, want it sent", err)
+	}
+}
+
+func TestRawRequestClientErrorTellsNothing(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	IniHttpClient(server.URL, zap.NewNop().Sugar())
+
+	if _, err := HttpCl.RawRequest(failFast(t), "/flaky", http.MethodGet, nil); err == nil {
+		t.Fatal("request answered by a 500 succeeded")
+	}
+	// neither a 4xx nor a request which can't be built resets the failures of the endpoint
+	status = http.StatusNotFound
+	var statusErr *StatusError
+	if _, err := HttpCl.RawRequest(context.Background(), "/flaky", http.MethodGet, nil); !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Fatalf("request answered by a 404 = %v, want the 404 status", err)
+	}
+	if _, err := HttpCl.RawRequest(context.Background(), "/flaky", "BAD METHOD", nil); err == nil {
+		t.Fatal("request with an invalid method was sent")
+	}
+	status = http.StatusInternalServerError
+	if _, err := HttpCl.RawRequest(failFast(t), "/flaky", http.MethodGet, nil); err == nil {
+		t.Fatal("request answered by a 500 succeeded")
+	}
+	if state := HttpCl.ServerState(); state != CircuitOpen {
+		t.Errorf("server state = %s, want open after two failures in a row", state)
+	}
+}
@@ -1,55 +1,186 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	maxAttempts = 4
+	// the backoff doubles from retryBaseDelay up to retryMaxDelay, a random part of it is waited
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+	// the circuit of an endpoint opens after breakerThreshold failed requests in a row to it and is
+	// probed after breakerCooldown
+	breakerThreshold = 2
+	breakerCooldown  = 5 * time.Second
 )
 
 var HttpCl *HttpClient
 
+// StatusError is returned when the server answers with an unexpected status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected status: " + e.Status
+}
+
 type HttpClient struct {
 	Client  *http.Client
 	baseUrl string
+	logger  *zap.SugaredLogger
+
+	breakersMutex sync.Mutex
+	// breakers are keyed by the path without its query, one broken endpoint doesn't fail the others
+	breakers map[string]*CircuitBreaker
 }
 
-func (cl *HttpClient) RawRequest(path string, method string, body io.Reader) (result []byte, err error) {
-	const maxRetries = 10
-	var resp *http.Response
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if method == http.MethodPost {
-			resp, err = cl.Client.Post(cl.baseUrl+path, "application/json", body)
-		} else {
-			resp, err = cl.Client.Get(cl.baseUrl + path)
+// RawRequest sends the request, retrying the network errors and the 5xx responses with a backoff.
+// The retries stop when ctx is done or when the next backoff would end past its deadline, so the
+// deadline bounds the whole request. The body is read once and replayed on each attempt.
+func (cl *HttpClient) RawRequest(ctx context.Context, path string, method string, body io.Reader) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
 		}
-		if err == nil && resp.StatusCode == http.StatusOK {
-			defer resp.Body.Close()
-			res, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, err
+	}
+	breaker := cl.breaker(path)
+	if err := breaker.Allow(); err != nil {
+		return nil, err
+	}
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var result []byte
+		var retry bool
+		result, retry, err = cl.do(ctx, path, method, payload)
+		if err == nil {
+			if breaker.Success() {
+				cl.logger.Infof("server is up again: %s answered", path)
 			}
-			return res, nil
+			return result, nil
+		}
+		if !retry {
+			// a 4xx or a request which couldn't be built, it tells nothing about the endpoint health
+			breaker.Cancel()
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, cl.abandon(ctx, breaker, path, attempt)
 		}
+		cl.logger.Debugf("%s attempt %d failed: %v", path, attempt, err)
+		if attempt == maxAttempts {
+			break
+		}
+		delay := backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, cl.fail(breaker, path, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, cl.abandon(ctx, breaker, path, attempt)
+		case <-time.After(delay):
+		}
+	}
+	return nil, cl.fail(breaker, path, maxAttempts, err)
+}
+
+// breaker returns the circuit breaker of the endpoint, creating it on the first request.
+func (cl *HttpClient) breaker(path string) *CircuitBreaker {
+	endpoint, _, _ := strings.Cut(path, "?")
+	cl.breakersMutex.Lock()
+	defer cl.breakersMutex.Unlock()
+	breaker, ok := cl.breakers[endpoint]
+	if !ok {
+		breaker = NewCircuitBreaker(breakerThreshold, breakerCooldown)
+		cl.breakers[endpoint] = breaker
+	}
+	return breaker
+}
+
+// fail records the failed request in the breaker of its endpoint.
+func (cl *HttpClient) fail(breaker *CircuitBreaker, path string, attempts int, err error) error {
+	if breaker.Failure() {
+		cl.logger.Errorf("server down: %s failed after %d attempts: %v", path, attempts, err)
+	}
+	return fmt.Errorf("%s failed after %d attempts: %w", path, attempts, err)
+}
+
+// abandon ends the request when ctx is done. A passed deadline counts as a server failure,
+// a cancelled request tells nothing about the server.
+func (cl *HttpClient) abandon(ctx context.Context, breaker *CircuitBreaker, path string, attempts int) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		cl.fail(breaker, path, attempts, ctx.Err())
+		return ctx.Err()
+	}
+	breaker.Cancel()
+	return ctx.Err()
+}
 
-		// Log error and retry
-		if err != nil {
-			fmt.Printf("Attempt %d: Request failed: %v\n", attempt, err)
-		} else {
-			fmt.Printf("Attempt %d: Unexpected status: %s\n", attempt, resp.Status)
-			resp.Body.Close()
+// ServerState returns the worst state of the endpoint circuits: open when any endpoint is down,
+// half-open while one is probed, closed otherwise.
+func (cl *HttpClient) ServerState() string {
+	cl.breakersMutex.Lock()
+	defer cl.breakersMutex.Unlock()
+	state := CircuitClosed
+	for _, breaker := range cl.breakers {
+		switch breaker.State() {
+		case CircuitOpen:
+			return CircuitOpen
+		case CircuitHalfOpen:
+			state = CircuitHalfOpen
 		}
+	}
+	return state
+}
 
-		time.Sleep(time.Second / 2)
+// do sends a single attempt, retry tells whether a failure may be retried.
+func (cl *HttpClient) do(ctx context.Context, path string, method string, payload []byte) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, cl.baseUrl+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, false, err
 	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := cl.Client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= http.StatusInternalServerError, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	result, err := io.ReadAll(resp.Body)
+	return result, true, err
+}
 
-	return nil, fmt.Errorf("failed after %d retries: %v", maxRetries, err)
+// backoff returns a random delay up to the exponential backoff of the attempt.
+func backoff(attempt int) time.Duration {
+	delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
 }
 
-func IniHttpClient(baseUrl string) {
+func IniHttpClient(baseUrl string, logger *zap.SugaredLogger) {
 	HttpCl = &HttpClient{
-		baseUrl: baseUrl,
+		baseUrl:  baseUrl,
+		logger:   logger,
+		breakers: make(map[string]*CircuitBreaker),
 		Client: &http.Client{
 			Timeout: 10 * time.Second,
 			Transport: &http.Transport{
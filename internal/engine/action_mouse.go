@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"image"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+	"github.com/gibgibik/go-lineage2-macros/internal/service"
+)
+
+// dragAction presses a button at the first point, moves to the second one and releases it there,
+// Additional is "x1,y1,x2,y2[,button]".
+func dragAction(r *Runner, item service.ProfileTemplateItem) error {
+	drag, err := service.ParseDragArgs(item.Additional, r.settings.Screen)
+	if err != nil {
+		return err
+	}
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.drag(drag)
+	r.delay(item)
+	return nil
+}
+
+// scrollAction turns the wheel, Additional is "notches[,x,y]" with positive notches scrolling up.
+func scrollAction(r *Runner, item service.ProfileTemplateItem) error {
+	scroll, err := service.ParseScrollArgs(item.Additional, r.settings.Screen)
+	if err != nil {
+		return err
+	}
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	notch := 1
+	if scroll.Notches < 0 {
+		notch = -1
+	}
+	for i := 0; i != scroll.Notches; i += notch {
+		r.control.MouseActionAbsolute(0, scroll.Point, service.WheelByte(notch))
+		r.wait(WaitMouseMove)
+	}
+	r.control.MouseAbsoluteEnd()
+	r.delay(item)
+	return nil
+}
+
+// rotateCameraAction moves the cursor by the "dx,dy" of Additional with the right button held,
+// relative to wherever it is.
+func rotateCameraAction(r *Runner, item service.ProfileTemplateItem) error {
+	delta, err := service.ParseRotateCameraArgs(item.Additional)
+	if err != nil {
+		return err
+	}
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.control.MouseActionRelative(ch9329.MousePressRight, image.Point{}, 0)
+	r.wait(WaitKeyTap)
+	for _, step := range service.RelativeSteps(delta) {
+		r.control.MouseActionRelative(ch9329.MousePressRight, step, 0)
+		r.wait(WaitMouseMove)
+	}
+	r.control.MouseActionRelative(0, image.Point{}, 0)
+	r.delay(item)
+	return nil
+}
+
+func (r *Runner) drag(drag service.MouseDrag) {
+	r.control.MouseActionAbsolute(drag.Button, drag.From, 0)
+	r.wait(WaitKeyTap)
+	for _, point := range service.DragPath(drag.From, drag.To) {
+		r.control.MouseActionAbsolute(drag.Button, point, 0)
+		r.wait(WaitMouseMove)
+	}
+	r.control.MouseAbsoluteEnd()
+}
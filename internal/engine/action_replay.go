@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/gibgibik/go-lineage2-macros/internal/service"
+)
+
+// replayAction plays back the recording named in Additional with its original timings,
+// see service.Recorder.
+func replayAction(r *Runner, item service.ProfileTemplateItem) error {
+	events, err := service.LoadRecording(item.Additional)
+	if err != nil {
+		return err
+	}
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	var offset int64
+	for _, event := range events {
+		if r.ctx.Err() != nil {
+			break
+		}
+		r.beat("replay")
+		if event.OffsetMs > offset {
+			r.sleep(time.Millisecond * time.Duration(event.OffsetMs-offset))
+			offset = event.OffsetMs
+		}
+		if err := service.ReplayEvent(r.control, event); err != nil {
+			r.control.EndKey()
+			r.control.MouseAbsoluteEnd()
+			return err
+		}
+	}
+	r.control.EndKey()
+	r.control.MouseAbsoluteEnd()
+	r.delay(item)
+	return nil
+}
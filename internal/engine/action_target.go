@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"errors"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+	"github.com/gibgibik/go-lineage2-macros/internal/service"
+)
+
+// wrongTarget checks the target against the target rules of the profile.
+func (r *Runner) wrongTarget(name string) bool {
+	friendly := append(service.PartyMemberNames(r.stats.Party()), r.settings.Characters...)
+	if ok, reason := r.targeting.Check(name, friendly); !ok {
+		r.logger.Info(name + ": " + reason)
+		return true
+	}
+	return false
+}
+
+// blacklisted checks the target against the blacklist, at the clicked position if it's known.
+func (r *Runner) blacklisted(name string) bool {
+	if r.targetClick != nil {
+		return r.targeting.Blacklisted(name, *r.targetClick, r.clock.Now())
+	}
+	return r.targeting.BlacklistedName(name, r.clock.Now())
+}
+
+// dropWrongTarget cancels the current target if it isn't the one we hunt for or it's blacklisted.
+func (r *Runner) dropWrongTarget() bool {
+	currentTarget, _ := serverRequest(r, r.server.GetCurrentTarget)
+	if currentTarget == "" {
+		return false
+	}
+	r.logger.Info("target is " + currentTarget)
+	if r.blacklisted(currentTarget) {
+		r.logger.Info(currentTarget + ": blacklisted target")
+	} else if !r.wrongTarget(currentTarget) {
+		return false
+	}
+	r.blacklistTarget(currentTarget)
+	r.pressKey("esc")
+	r.wait(WaitStep)
+	return true
+}
+
+// dropStuckTarget cancels the target which stays at full HP for too long, e.g. an unreachable one.
+func (r *Runner) dropStuckTarget() bool {
+	playerStat := r.stats.PlayerStat(r.pid)
+	if playerStat == nil || playerStat.Target.HpPercent < 99 || playerStat.Target.FullHpUnchangedSince == 0 {
+		return false
+	}
+	if r.clock.Now().UnixMilli()-playerStat.Target.FullHpUnchangedSince <= r.targeting.FullHpTimeout().Milliseconds() {
+		return false
+	}
+	currentTarget, _ := serverRequest(r, r.server.GetCurrentTarget)
+	r.logger.Info(currentTarget + ": target stays at full hp")
+	r.blacklistTarget(currentTarget)
+	r.pressKey("esc")
+	r.wait(WaitStep)
+	return true
+}
+
+// blacklistTarget skips the target for a while: in its screen region when /aitargetnext clicked it,
+// by name otherwise.
+func (r *Runner) blacklistTarget(name string) {
+	if name == "" {
+		return
+	}
+	if r.targetClick != nil {
+		r.targeting.Blacklist(name, *r.targetClick, r.clock.Now())
+	} else {
+		r.targeting.BlacklistName(name, r.clock.Now())
+	}
+	r.logger.Info(name + ": target blacklisted")
+	r.targetClick = nil
+}
+
+func attackAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	if r.dropWrongTarget() || r.dropStuckTarget() {
+		return ErrSkipped
+	}
+	r.pressItem(item)
+	r.delay(item)
+	return nil
+}
+
+// targetAction presses the in-game target binding and, when Additional holds a name, checks
+// that this target was selected.
+func targetAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.targetClick = nil
+	r.pressItem(item)
+	r.wait(WaitStep)
+	if item.Additional != "" {
+		currentTarget, err := serverRequest(r, r.server.GetCurrentTarget)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(currentTarget, item.Additional) {
+			r.logger.Info("target is " + currentTarget + ", expected " + item.Additional)
+			r.pressKey("esc")
+			return ErrSkipped
+		}
+	}
+	r.delay(item)
+	return nil
+}
+
+func targetNextAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.targetClick = nil
+	r.pressItem(item)
+	r.wait(WaitStep)
+	if r.dropWrongTarget() {
+		return ErrSkipped
+	}
+	r.delay(item)
+	return nil
+}
+
+// assistAction selects the party member from Additional, if any, and presses the in-game assist binding.
+func assistAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	var point image.Point
+	if item.Additional != "" {
+		var ok bool
+		if point, ok = service.AssistPartyMemberMap[item.Additional]; !ok {
+			return errors.New("wrong additional for assist: " + item.Additional)
+		}
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.targetClick = nil
+	if item.Additional != "" {
+		r.control.MouseActionAbsolute(ch9329.MousePressLeft, point, 0)
+		r.control.MouseAbsoluteEnd()
+		r.wait(WaitStep)
+	}
+	r.pressItem(item)
+	r.delay(item)
+	return nil
+}
+
+func assistPartyMemberAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	member := item.Additional
+	if member == service.AssistPartyMemberLowest {
+		index, ok := service.PartyLowestMemberIndex(r.stats.Party(), "hp")
+		if !ok {
+			return ErrSkipped
+		}
+		member = strconv.Itoa(index)
+	}
+	point, ok := service.AssistPartyMemberMap[member]
+	if !ok {
+		return errors.New("wrong additional for assist party member: " + item.Additional)
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.control.MouseActionAbsolute(ch9329.MousePressRight, point, 0)
+	r.control.MouseAbsoluteEnd()
+	r.delay(item)
+	return nil
+}
+
+func aiTargetNextAction(r *Runner, item service.ProfileTemplateItem) error {
+	if r.runnerType == TypeSecondary {
+		r.logger.Error("ainexttarget isn't supported by the bot yet")
+		return ErrSkipped
+	}
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	bounds, err := serverRequest(r, r.server.FindBounds)
+	if err != nil {
+		r.logger.Error("find bounds error: " + err.Error())
+		return ErrSkipped
+	}
+	if bounds == nil {
+		return nil
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.control.SendKey(ch9329.ModLeftShift, "z") //stay
+	r.wait(WaitStep)
+	r.targetClick = nil
+	for _, candidate := range r.targeting.RankBoxes(bounds.Boxes, r.settings.Screen, r.clock.Now()) {
+		if r.targetHpPercent() > 0 {
+			break
+		}
+		// the name is only known if the box was clicked recently, only the spot of a blacklisted target is skipped otherwise
+		if r.targeting.Blacklisted(candidate.Name, candidate.Click, r.clock.Now()) {
+			continue
+		}
+		r.control.MouseActionAbsolute(ch9329.MousePressLeft, candidate.Click, 0)
+		r.control.MouseAbsoluteEnd()
+		r.wait(WaitStep)
+		currentTarget, _ := serverRequest(r, r.server.GetCurrentTarget)
+		if currentTarget == "" {
+			r.targeting.Remember(candidate.Click, "", true, r.clock.Now())
+			continue
+		}
+		r.logger.Info("target is " + currentTarget)
+		click := candidate.Click
+		r.targetClick = &click
+		if r.targeting.Blacklisted(currentTarget, click, r.clock.Now()) {
+			r.targeting.Remember(candidate.Click, currentTarget, true, r.clock.Now())
+			r.blacklistTarget(currentTarget)
+			r.pressKey("esc")
+			r.wait(WaitStep)
+			continue
+		}
+		wrong := r.wrongTarget(currentTarget)
+		r.targeting.Remember(candidate.Click, currentTarget, wrong, r.clock.Now())
+		if !wrong {
+			break
+		}
+		r.blacklistTarget(currentTarget)
+		r.wait(WaitStep)
+	}
+	if r.targetHpPercent() == 0 {
+		r.control.MouseActionAbsolute(ch9329.MousePressRight, image.Pt(480, 320), 0)
+		r.control.MouseActionAbsolute(ch9329.MousePressRight, image.Pt(580, 320), 0)
+		r.control.MouseAbsoluteEnd()
+	}
+	r.control.EndKey()
+	return nil
+}
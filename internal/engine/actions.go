@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"image"
+	"strconv"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+	"github.com/gibgibik/go-lineage2-macros/internal/service"
+)
+
+// ActionHandler executes a single profile item once its period and conditions are satisfied.
+// Returning ErrSkipped keeps the item due on the next cycle.
+type ActionHandler interface {
+	Handle(r *Runner, item service.ProfileTemplateItem) error
+}
+
+// ActionHandlerFunc adapts a plain function to ActionHandler.
+type ActionHandlerFunc func(r *Runner, item service.ProfileTemplateItem) error
+
+func (f ActionHandlerFunc) Handle(r *Runner, item service.ProfileTemplateItem) error {
+	return f(r, item)
+}
+
+var actions = map[string]ActionHandler{}
+
+// RegisterAction makes the handler available to profiles under the given action name.
+func RegisterAction(name string, handler ActionHandler) {
+	actions[name] = handler
+}
+
+func GetAction(name string) (ActionHandler, bool) {
+	handler, ok := actions[name]
+	return handler, ok
+}
+
+func init() {
+	RegisterAction(service.ActionPress, ActionHandlerFunc(pressAction))
+	RegisterAction(service.ActionDelay, ActionHandlerFunc(delayAction))
+	RegisterAction(service.ActionStop, ActionHandlerFunc(stopAction))
+	RegisterAction(service.ActionUnstuck, ActionHandlerFunc(unstuckAction))
+	RegisterAction(service.ActionPickup, ActionHandlerFunc(pickupAction))
+	RegisterAction(service.ActionAttack, ActionHandlerFunc(attackAction))
+	RegisterAction(service.ActionTarget, ActionHandlerFunc(targetAction))
+	RegisterAction(service.ActionTargetNext, ActionHandlerFunc(targetNextAction))
+	RegisterAction(service.ActionAssist, ActionHandlerFunc(assistAction))
+	RegisterAction(service.ActionAssistPartyMember, ActionHandlerFunc(assistPartyMemberAction))
+	RegisterAction(service.ActionAITargetNext, ActionHandlerFunc(aiTargetNextAction))
+	RegisterAction(service.ActionDrag, ActionHandlerFunc(dragAction))
+	RegisterAction(service.ActionScroll, ActionHandlerFunc(scrollAction))
+	RegisterAction(service.ActionRotateCamera, ActionHandlerFunc(rotateCameraAction))
+	RegisterAction(service.ActionReplay, ActionHandlerFunc(replayAction))
+}
+
+func pressAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.pressItem(item)
+	r.delay(item)
+	return nil
+}
+
+func delayAction(r *Runner, item service.ProfileTemplateItem) error {
+	r.delay(item)
+	return nil
+}
+
+// stopAction presses the binding and stops the runner once the period since the profile load
+// has elapsed and there is no target.
+func stopAction(r *Runner, item service.ProfileTemplateItem) error {
+	if item.PeriodMilliseconds <= 0 || r.loadedAt.UnixMilli()+item.PeriodMilliseconds >= r.clock.Now().UnixMilli() {
+		return ErrSkipped
+	}
+	if r.targetHpPercent() != 0 {
+		return ErrSkipped
+	}
+	if err := r.requireControl(); err == nil && r.acquireForeground() == nil {
+		r.pressItem(item)
+		r.delay(item)
+	}
+	r.wait(WaitStop)
+	return errStopRequested
+}
+
+func unstuckAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	r.control.MouseActionAbsolute(ch9329.MousePressLeft, image.Point{960, 540 + 300}, 0)
+	r.wait(WaitKeyTap)
+	r.control.MouseAbsoluteEnd()
+	r.wait(WaitUnstuck)
+	r.pressItem(item)
+	r.wait(WaitStep)
+	r.pressKey("esc")
+	r.delay(item)
+	return nil
+}
+
+// pickupAction presses the binding the number of times given in Additional, once by default.
+func pickupAction(r *Runner, item service.ProfileTemplateItem) error {
+	if err := r.requireControl(); err != nil {
+		return err
+	}
+	count := additionalInt(item, 1)
+	if err := r.acquireForeground(); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		r.pressItem(item)
+		r.wait(WaitStep)
+	}
+	r.delay(item)
+	return nil
+}
+
+func additionalInt(item service.ProfileTemplateItem, def int) int {
+	if val, err := strconv.Atoi(item.Additional); err == nil && val > 0 {
+		return val
+	}
+	return def
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrForegroundTimeout = errors.New("foreground wasn't granted in time")
+
+// ArbiterSettings tune the foreground arbiter, zero values disable the corresponding limits.
+type ArbiterSettings struct {
+	// AcquireTimeout is how long a runner waits for the foreground before it skips the action
+	AcquireTimeout time.Duration
+	// MaxHold is how long a runner may keep the foreground while others are waiting
+	MaxHold time.Duration
+	// Aging raises the priority of a waiting runner by one every Aging, so low priorities don't starve
+	Aging time.Duration
+}
+
+type foregroundRequest struct {
+	pid      uint32
+	priority int
+	since    time.Time
+	granted  chan struct{}
+}
+
+// Arbiter grants the keyboard and mouse of a shared device to one runner at a time. Waiting runners
+// are served by priority, the oldest first on a tie, and the holder is asked to give the foreground
+// up when a runner with a higher priority is waiting or it held it longer than MaxHold.
+type Arbiter struct {
+	mutex          sync.Mutex
+	clock          Clock
+	settings       ArbiterSettings
+	holder         uint32
+	holderPriority int
+	heldAt         time.Time
+	waiting        []*foregroundRequest
+}
+
+func NewArbiter(clock Clock, settings ArbiterSettings) *Arbiter {
+	return &Arbiter{
+		clock:    clock,
+		settings: settings,
+	}
+}
+
+// Acquire blocks until the foreground is granted to the PID, ctx is done or AcquireTimeout elapses.
+func (a *Arbiter) Acquire(ctx context.Context, pid uint32, priority int) error {
+	a.mutex.Lock()
+	if a.holder == pid {
+		a.holderPriority = max(a.holderPriority, priority)
+		a.mutex.Unlock()
+		return nil
+	}
+	if a.holder == 0 && len(a.waiting) == 0 {
+		a.grant(&foregroundRequest{pid: pid, priority: priority})
+		a.mutex.Unlock()
+		return nil
+	}
+	req := &foregroundRequest{pid: pid, priority: priority, since: a.clock.Now(), granted: make(chan struct{})}
+	a.waiting = append(a.waiting, req)
+	a.mutex.Unlock()
+
+	if a.settings.AcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.settings.AcquireTimeout)
+		defer cancel()
+	}
+	select {
+	case <-req.granted:
+		return nil
+	case <-ctx.Done():
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	select {
+	case <-req.granted:
+		// granted meanwhile, pass it on
+		a.release(pid)
+	default:
+		a.waiting = slices.DeleteFunc(a.waiting, func(waiting *foregroundRequest) bool {
+			return waiting == req
+		})
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrForegroundTimeout
+	}
+	return ctx.Err()
+}
+
+// Release gives the foreground up if the PID holds it.
+func (a *Arbiter) Release(pid uint32) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.release(pid)
+}
+
+// Preempted reports whether the holder PID should give the foreground up to a waiting runner.
+func (a *Arbiter) Preempted(pid uint32) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.holder != pid || len(a.waiting) == 0 {
+		return false
+	}
+	now := a.clock.Now()
+	if a.settings.MaxHold > 0 && now.Sub(a.heldAt) > a.settings.MaxHold {
+		return true
+	}
+	return a.effectivePriority(a.waiting[a.next(now)], now) > a.holderPriority
+}
+
+// Holder returns the PID holding the foreground, 0 if none.
+func (a *Arbiter) Holder() uint32 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.holder
+}
+
+func (a *Arbiter) release(pid uint32) {
+	if a.holder != pid {
+		return
+	}
+	a.holder = 0
+	if len(a.waiting) == 0 {
+		return
+	}
+	i := a.next(a.clock.Now())
+	req := a.waiting[i]
+	a.waiting = slices.Delete(a.waiting, i, i+1)
+	a.grant(req)
+	close(req.granted)
+}
+
+func (a *Arbiter) grant(req *foregroundRequest) {
+	a.holder = req.pid
+	a.holderPriority = req.priority
+	a.heldAt = a.clock.Now()
+}
+
+// next returns the index of the waiting request to serve first.
+func (a *Arbiter) next(now time.Time) int {
+	best := 0
+	for i, req := range a.waiting {
+		if a.effectivePriority(req, now) > a.effectivePriority(a.waiting[best], now) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (a *Arbiter) effectivePriority(req *foregroundRequest, now time.Time) int {
+	if a.settings.Aging <= 0 {
+		return req.priority
+	}
+	return req.priority + int(now.Sub(req.since)/a.settings.Aging)
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+)
+
+// RegistryEntry is a runner with the device it drives.
+type RegistryEntry struct {
+	Runner *Runner
+	Device string
+	// Arbiter is shared by the runners of the device, nil for a dedicated one
+	Arbiter *Arbiter
+}
+
+// Registry holds the runners of every PID, it's safe for concurrent use.
+type Registry struct {
+	mutex   sync.RWMutex
+	entries map[uint32]RegistryEntry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{entries: make(map[uint32]RegistryEntry)}
+}
+
+// Init fills the registry with the entries returned by build, once. It reports whether build was called.
+func (g *Registry) Init(build func() []RegistryEntry) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.entries) > 0 {
+		return false
+	}
+	for _, entry := range build() {
+		g.entries[entry.Runner.Pid()] = entry
+	}
+	return true
+}
+
+func (g *Registry) Get(pid uint32) (RegistryEntry, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	entry, ok := g.entries[pid]
+	return entry, ok
+}
+
+// Runners returns the runners ordered by PID.
+func (g *Registry) Runners() []*Runner {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	runners := make([]*Runner, 0, len(g.entries))
+	for _, entry := range g.entries {
+		runners = append(runners, entry.Runner)
+	}
+	sort.Slice(runners, func(i, j int) bool {
+		return runners[i].Pid() < runners[j].Pid()
+	})
+	return runners
+}
+
+// Statuses returns the state of every runner ordered by PID, with the device it drives and whether
+// it holds the device: the foreground of a shared one, a dedicated one while it runs.
+func (g *Registry) Statuses() []RunnerStatus {
+	runners := g.Runners()
+	result := make([]RunnerStatus, len(runners))
+	for i, runner := range runners {
+		entry, _ := g.Get(runner.Pid())
+		result[i] = runner.Status()
+		result[i].Device = entry.Device
+		if entry.Arbiter != nil {
+			result[i].HoldsDevice = entry.Arbiter.Holder() == runner.Pid()
+		} else {
+			result[i].HoldsDevice = runner.Running()
+		}
+	}
+	return result
+}
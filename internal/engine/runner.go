@@ -0,0 +1,683 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-macros/internal/service"
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+	"go.uber.org/zap"
+)
+
+const (
+	TypeMain = iota
+	TypeSecondary
+	// TypeDedicated drives a device of its own, so it never switches the foreground window
+	TypeDedicated
+)
+
+// Runner states, see Runner.Status.
+const (
+	StateIdle              = "idle"
+	StateRunning           = "running"
+	StatePaused            = "paused"
+	StateWaitingForeground = "waiting-for-foreground"
+	StateStopped           = "stopped"
+	StateError             = "error"
+)
+
+var (
+	ErrAlreadyRunning = errors.New("already running")
+	// ErrSkipped is returned by action handlers when the item did not run, so its period isn't restarted.
+	ErrSkipped       = errors.New("action skipped")
+	errStopRequested = errors.New("stop requested")
+	errForceStopped  = errors.New("force stopped")
+)
+
+// serverRequestTimeout bounds a server request with its retries, well below the watchdog StuckAfter,
+// so a down server doesn't stall the run.
+const serverRequestTimeout = 3 * time.Second
+
+// Control drives the game, see service.GetControl for the available drivers.
+type Control = service.Controller
+
+// StatsSource gives the runner the latest known stats.
+type StatsSource interface {
+	PlayerStat(pid uint32) *entity.PlayerStat
+	Party() map[uint8]entity.PartyMember
+	// ReceivedAt is the time the stats of the PID were last updated, zero if never
+	ReceivedAt(pid uint32) time.Time
+	// History returns the recent samples of the PID, oldest first
+	History(pid uint32, now time.Time) []service.StatSample
+}
+
+// Settings tune the runner behaviour, zero values disable the corresponding checks.
+type Settings struct {
+	// StatsMaxAge is how old the stats may get before the runner pauses
+	StatsMaxAge time.Duration
+	// Timing gives the duration of every wait, see NewTiming
+	Timing Timing
+	// Screen bounds the mouse actions coordinates, empty disables the check
+	Screen image.Rectangle
+	// Characters are the names of the own characters, they're never targeted
+	Characters []string
+}
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type stackItem struct {
+	item           service.ProfileTemplateItem
+	lastRun        time.Time
+	conditionState *service.ConditionState
+}
+
+// runHandle controls a single run of the runner.
+type runHandle struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	arbiter *Arbiter
+}
+
+// RunnerStatus is a snapshot of the runner state.
+type RunnerStatus struct {
+	Pid     uint32    `json:"pid"`
+	State   string    `json:"state"`
+	Profile string    `json:"profile,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Since   time.Time `json:"since"`
+	// Device and HoldsDevice are filled by Registry.Statuses
+	Device      string `json:"device,omitempty"`
+	HoldsDevice bool   `json:"holds_device"`
+}
+
+// heartbeat is the last time the run goroutine made progress and where.
+type heartbeat struct {
+	mutex sync.Mutex
+	at    time.Time
+	where string
+	// until is the end of a deliberate wait, the runner isn't expected to make progress before it
+	until time.Time
+}
+
+// runnerCore is the state of a runner shared by its runs, the web handlers and the watchdog.
+type runnerCore struct {
+	pid        uint32
+	runnerType uint8
+	stats      StatsSource
+	server     service.ServerClient
+	clock      Clock
+	settings   Settings
+	seed       uint64
+
+	current           atomic.Pointer[runHandle]
+	paused            atomic.Bool
+	reloadRequested   atomic.Bool
+	waitingForeground atomic.Bool
+	statusMutex       sync.Mutex
+	// status holds idle, running, stopped or error, paused and waiting are derived from the flags
+	status RunnerStatus
+	// wakeCh wakes the run goroutine up when it's paused, it never blocks the sender
+	wakeCh    chan struct{}
+	heartbeat heartbeat
+}
+
+// Runner owns the macros stack of a single PID and executes it in its own goroutine. Every run
+// gets a Runner of its own sharing the runnerCore, so a run abandoned by ForceStop never touches
+// the state of the next one.
+type Runner struct {
+	*runnerCore
+
+	// owned by the run goroutine
+	handle    *runHandle
+	rnd       *rand.Rand
+	profile   string
+	control   Control
+	arbiter   *Arbiter
+	ctx       context.Context
+	logger    *zap.SugaredLogger
+	action    string
+	priority  int
+	stack     []stackItem
+	variables map[string]float64
+	targeting *service.Targeting
+	// targetClick is where /aitargetnext clicked the current target, nil if it was selected otherwise
+	targetClick    *image.Point
+	loadedAt       time.Time
+	windowSwitched bool
+	previousStat   *entity.PlayerStat
+	previousParty  map[uint8]entity.PartyMember
+	statsStale     bool
+	deviceDown     bool
+}
+
+// NewRunner seeds the random waits of the runner with the timing seed and the PID, so runs are
+// reproducible with a fixed seed and a Clock which doesn't sleep.
+func NewRunner(pid uint32, runnerType uint8, stats StatsSource, server service.ServerClient, clock Clock, settings Settings) *Runner {
+	seed := settings.Timing.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &Runner{runnerCore: &runnerCore{
+		pid:        pid,
+		runnerType: runnerType,
+		stats:      stats,
+		server:     server,
+		clock:      clock,
+		settings:   settings,
+		seed:       seed,
+		wakeCh:     make(chan struct{}, 1),
+		status:     RunnerStatus{Pid: pid, State: StateIdle, Since: clock.Now()},
+	}}
+}
+
+func (r *Runner) Pid() uint32 {
+	return r.pid
+}
+
+func (r *Runner) Running() bool {
+	return r.current.Load() != nil
+}
+
+func (r *Runner) Paused() bool {
+	return r.paused.Load()
+}
+
+// Status returns the current state of the runner.
+func (r *Runner) Status() RunnerStatus {
+	r.statusMutex.Lock()
+	status := r.status
+	r.statusMutex.Unlock()
+	if status.State != StateRunning {
+		return status
+	}
+	switch {
+	case r.paused.Load():
+		status.State = StatePaused
+	case r.waitingForeground.Load():
+		status.State = StateWaitingForeground
+	}
+	return status
+}
+
+func (r *Runner) setStatus(state string, profile string, err error) {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	r.status = RunnerStatus{Pid: r.pid, State: state, Profile: profile, Since: r.clock.Now()}
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+}
+
+// Heartbeat returns when and where the run goroutine last made progress. A deliberate wait
+// counts as progress until it ends, so long sleeps and holds aren't reported as stuck.
+func (r *Runner) Heartbeat() (time.Time, string) {
+	r.heartbeat.mutex.Lock()
+	defer r.heartbeat.mutex.Unlock()
+	if r.heartbeat.until.After(r.heartbeat.at) {
+		return r.heartbeat.until, r.heartbeat.where
+	}
+	return r.heartbeat.at, r.heartbeat.where
+}
+
+// Start runs the profile until Stop is called or ctx is done. Control may be nil, in which case
+// only the actions which don't need input devices are executed. Arbiter is shared by the runners
+// driving the same device, nil when the runner has a device of its own.
+func (r *Runner) Start(ctx context.Context, profile string, control Control, arbiter *Arbiter, logger *zap.SugaredLogger) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	handle := &runHandle{cancel: cancel, done: make(chan struct{}), arbiter: arbiter}
+	if !r.current.CompareAndSwap(nil, handle) {
+		cancel()
+		return ErrAlreadyRunning
+	}
+	run := &Runner{
+		runnerCore: r.runnerCore,
+		handle:     handle,
+		rnd:        rand.New(rand.NewPCG(r.seed, uint64(r.pid))),
+		profile:    profile,
+		control:    control,
+		arbiter:    arbiter,
+		ctx:        runCtx,
+		logger:     logger,
+	}
+	r.paused.Store(false)
+	r.reloadRequested.Store(false)
+	r.waitingForeground.Store(false)
+	r.setStatus(StateRunning, profile, nil)
+	run.beat("start")
+	go run.run(handle)
+	return nil
+}
+
+// Stop cancels the run, every wait of the runner returns as soon as it's cancelled. It never blocks.
+func (r *Runner) Stop() {
+	if handle := r.current.Load(); handle != nil {
+		handle.cancel()
+	}
+}
+
+// ForceStop cancels the run and gives the foreground up on behalf of the runner, so the runners
+// sharing its device go on even if it stays stuck. The runner can be started again right away,
+// a run which stays stuck is abandoned. It reports whether the run ended within timeout.
+func (r *Runner) ForceStop(timeout time.Duration) bool {
+	handle := r.current.Load()
+	if handle == nil {
+		return true
+	}
+	handle.cancel()
+	if !r.current.CompareAndSwap(handle, nil) {
+		// the run has just ended by itself
+		return true
+	}
+	if handle.arbiter != nil {
+		handle.arbiter.Release(r.pid)
+	}
+	r.paused.Store(false)
+	r.waitingForeground.Store(false)
+	r.setStatus(StateError, r.Status().Profile, errForceStopped)
+	select {
+	case <-handle.done:
+		return true
+	case <-r.clock.After(timeout):
+		return false
+	}
+}
+
+func (r *Runner) Pause() {
+	if r.Running() && r.paused.CompareAndSwap(false, true) {
+		r.wake()
+	}
+}
+
+func (r *Runner) Resume() {
+	if r.paused.CompareAndSwap(true, false) {
+		r.wake()
+	}
+}
+
+// Reload drops the loaded stack so the profile is read again on the next cycle.
+func (r *Runner) Reload() {
+	if r.Running() {
+		r.reloadRequested.Store(true)
+	}
+}
+
+func (r *Runner) wake() {
+	select {
+	case r.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// abandoned reports whether ForceStop gave the run up, it must leave the shared state alone then.
+func (r *Runner) abandoned() bool {
+	return r.current.Load() != r.handle
+}
+
+func (r *Runner) beat(where string) {
+	if r.abandoned() {
+		return
+	}
+	r.heartbeat.mutex.Lock()
+	defer r.heartbeat.mutex.Unlock()
+	r.heartbeat.at = r.clock.Now()
+	r.heartbeat.where = where
+	r.heartbeat.until = time.Time{}
+}
+
+// beatWaiting marks the start of a deliberate wait of d, keeping where the runner is.
+func (r *Runner) beatWaiting(d time.Duration) {
+	if r.abandoned() {
+		return
+	}
+	r.heartbeat.mutex.Lock()
+	defer r.heartbeat.mutex.Unlock()
+	r.heartbeat.at = r.clock.Now()
+	r.heartbeat.until = r.heartbeat.at.Add(d)
+}
+
+func (r *Runner) run(handle *runHandle) {
+	var runErr error
+	defer func() {
+		r.stack = nil
+		if !r.abandoned() {
+			r.releaseForeground()
+			r.paused.Store(false)
+			if runErr != nil {
+				r.setStatus(StateError, r.profile, runErr)
+			} else {
+				r.setStatus(StateStopped, r.profile, nil)
+			}
+			r.current.CompareAndSwap(handle, nil)
+		}
+		close(handle.done)
+	}()
+	paused := false
+	for {
+		r.beat("loop")
+		if r.ctx.Err() != nil {
+			r.logger.Info("macros stopped")
+			return
+		}
+		if r.reloadRequested.Swap(false) {
+			r.stack = nil
+			r.logger.Info("reloaded")
+		}
+		if r.paused.Load() {
+			if !paused {
+				paused = true
+				r.releaseForeground()
+				r.logger.Info("pause from web context")
+			}
+			select {
+			case <-r.ctx.Done():
+			case <-r.wakeCh:
+			}
+			continue
+		}
+		if paused {
+			paused = false
+			r.logger.Info("continue from web context")
+		}
+		err := r.cycle()
+		if errors.Is(err, errStopRequested) {
+			r.logger.Debug("macros stopped due to stop!!!")
+			return
+		}
+		if err != nil {
+			r.logger.Error("init stacks error: " + err.Error())
+			runErr = err
+			return
+		}
+	}
+}
+
+func (r *Runner) load() error {
+	if len(r.stack) > 0 {
+		return nil
+	}
+	profileData, err := service.GetProfile(r.profile)
+	if err != nil {
+		return err
+	}
+	// the profile may be written for another device, its coordinates must fit the screen of this one
+	if err := profileData.Validate(r.settings.Screen); err != nil {
+		return err
+	}
+	r.variables = profileData.Variables
+	if r.targeting == nil {
+		r.targeting, err = service.NewTargeting(profileData.Targets)
+	} else {
+		err = r.targeting.SetRules(profileData.Targets)
+	}
+	if err != nil {
+		return err
+	}
+	for _, val := range profileData.Items {
+		if val.Action == "" {
+			continue
+		}
+		r.stack = append(r.stack, stackItem{item: val, conditionState: service.NewConditionState()})
+	}
+	if len(r.stack) == 0 {
+		return errors.New("no actions available")
+	}
+	r.loadedAt = r.clock.Now()
+	return nil
+}
+
+// cycle runs every item of the stack once.
+func (r *Runner) cycle() error {
+	if err := r.load(); err != nil {
+		return err
+	}
+	if r.waitFreshStats() || r.waitDevice() {
+		return nil
+	}
+	for i := range r.stack {
+		if r.ctx.Err() != nil {
+			break
+		}
+		if r.arbiter != nil {
+			r.yieldForeground()
+		}
+		if err := r.runItem(&r.stack[i]); err != nil {
+			r.releaseForeground()
+			return err
+		}
+	}
+	r.releaseForeground()
+	r.previousStat = r.stats.PlayerStat(r.pid)
+	r.previousParty = r.stats.Party()
+	r.wait(WaitTick)
+	return nil
+}
+
+// waitFreshStats reports true and sleeps a bit while the stats of the PID are older than allowed,
+// so the run loop keeps handling stop and pause in the meantime.
+func (r *Runner) waitFreshStats() bool {
+	if r.settings.StatsMaxAge <= 0 {
+		return false
+	}
+	receivedAt := r.stats.ReceivedAt(r.pid)
+	stale := receivedAt.IsZero() || r.clock.Now().Sub(receivedAt) > r.settings.StatsMaxAge
+	if stale != r.statsStale {
+		r.statsStale = stale
+		if receivedAt.IsZero() {
+			r.logger.Warn("stats were not received yet, macros paused")
+		} else if stale {
+			r.logger.Warnf("stats are stale since %s, macros paused", receivedAt.Format(time.TimeOnly))
+		} else {
+			r.logger.Info("stats are fresh again, macros resumed")
+		}
+	}
+	if stale {
+		r.wait(WaitPoll)
+	}
+	return stale
+}
+
+// waitDevice reports true and sleeps a bit while the control device is reconnecting.
+func (r *Runner) waitDevice() bool {
+	reporter, ok := r.control.(service.StatusReporter)
+	if !ok {
+		return false
+	}
+	status := reporter.Status()
+	down := status.State != service.DeviceConnected
+	if down != r.deviceDown {
+		r.deviceDown = down
+		if down {
+			r.logger.Warnf("control device is %s, macros paused", status.State)
+		} else {
+			r.logger.Info("control device is connected again, macros resumed")
+		}
+	}
+	if down {
+		r.wait(WaitPoll)
+	}
+	return down
+}
+
+func (r *Runner) runItem(entry *stackItem) error {
+	handler, ok := GetAction(entry.item.Action)
+	if !ok {
+		r.logger.Error("unsupported action: " + entry.item.Action)
+		return nil
+	}
+	if entry.item.PeriodMilliseconds > 0 && entry.lastRun.UnixMilli() > (r.clock.Now().UnixMilli()-entry.item.PeriodMilliseconds) {
+		return nil
+	}
+	r.beat(entry.item.Action)
+	r.action = entry.item.Action
+	r.priority = entry.item.Priority
+	defer func() {
+		r.action = ""
+		r.priority = 0
+	}()
+	if ok, err := service.CheckConditionGroup(entry.item.Query, r.conditionEnv(entry.conditionState), r.logger); !ok {
+		if err != nil {
+			r.logger.Error("check condition error: " + err.Error())
+		}
+		return nil
+	}
+	err := handler.Handle(r, entry.item)
+	switch {
+	case errors.Is(err, errStopRequested):
+		return err
+	case errors.Is(err, ErrSkipped):
+		return nil
+	case err != nil:
+		r.logger.Error(entry.item.Action + " error: " + err.Error())
+		return nil
+	}
+	entry.lastRun = r.clock.Now()
+	r.wait(WaitActionGap)
+	return nil
+}
+
+func (r *Runner) conditionEnv(state *service.ConditionState) service.ConditionEnv {
+	now := r.clock.Now()
+	return service.ConditionEnv{
+		Stat:          r.stats.PlayerStat(r.pid),
+		Party:         r.stats.Party(),
+		PreviousStat:  r.previousStat,
+		PreviousParty: r.previousParty,
+		History:       r.stats.History(r.pid, now),
+		Variables:     r.variables,
+		Now:           now,
+		Random:        r.rnd,
+		State:         state,
+	}
+}
+
+func (r *Runner) targetHpPercent() float64 {
+	if playerStat := r.stats.PlayerStat(r.pid); playerStat != nil {
+		return playerStat.Target.HpPercent
+	}
+	return 0
+}
+
+// requireControl is called by the handlers before sending any input.
+func (r *Runner) requireControl() error {
+	if r.control == nil {
+		r.logger.Error("control cl is nil")
+		return ErrSkipped
+	}
+	return nil
+}
+
+// wait sleeps for the named wait of the current action.
+func (r *Runner) wait(name string) {
+	r.sleep(r.duration(name))
+}
+
+// sleep returns early when the run is cancelled. The watchdog doesn't count the sleep as a hang.
+func (r *Runner) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	r.beatWaiting(d)
+	select {
+	case <-r.ctx.Done():
+	case <-r.clock.After(d):
+	}
+}
+
+// serverRequest calls the server with a deadline of serverRequestTimeout.
+func serverRequest[T any](r *Runner, request func(ctx context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, serverRequestTimeout)
+	defer cancel()
+	return request(ctx)
+}
+
+func (r *Runner) duration(name string) time.Duration {
+	return r.settings.Timing.Range(r.action, name).Pick(r.rnd)
+}
+
+func (r *Runner) pressKey(binding string) {
+	r.holdKey(binding, r.duration(WaitKeyTap), nil)
+}
+
+// pressItem presses the binding of the item for its hold time, or until its hold_until condition is true.
+func (r *Runner) pressItem(item service.ProfileTemplateItem) {
+	hold := r.duration(WaitKeyTap)
+	if item.HoldMilliseconds > 0 {
+		hold = time.Millisecond * time.Duration(item.HoldMilliseconds)
+	}
+	if item.HoldUntilQuery == nil {
+		r.holdKey(item.Binding, hold, nil)
+		return
+	}
+	if item.HoldMilliseconds <= 0 {
+		hold = time.Millisecond * service.DefaultHoldUntilMilliseconds
+	}
+	state := service.NewConditionState()
+	r.holdKey(item.Binding, hold, func() bool {
+		ok, err := service.CheckConditionGroup(item.HoldUntilQuery, r.conditionEnv(state), r.logger)
+		if err != nil {
+			r.logger.Error("check hold_until error: " + err.Error())
+			return true
+		}
+		return ok
+	})
+}
+
+// holdKey taps every chord of the binding in order, the modifiers and keys of a chord are pressed
+// at once for hold. When until is set, the last chord is released as soon as it returns true or hold elapses.
+func (r *Runner) holdKey(binding string, hold time.Duration, until func() bool) {
+	keyBinding, err := service.ParseBinding(binding)
+	if err != nil {
+		r.logger.Error(err.Error())
+		return
+	}
+	for i, chord := range keyBinding {
+		if i > 0 {
+			r.wait(WaitStep)
+		}
+		if _, err := r.control.SendKeys(chord.Modifier, chord.Keys); err != nil {
+			r.logger.Error("send keys error: " + err.Error())
+		}
+		if until != nil && i == len(keyBinding)-1 {
+			r.holdUntil(hold, until)
+		} else {
+			r.sleep(hold)
+		}
+		r.control.EndKey()
+	}
+}
+
+func (r *Runner) holdUntil(hold time.Duration, until func() bool) {
+	deadline := r.clock.Now().Add(hold)
+	for r.ctx.Err() == nil && !until() {
+		r.beat("hold")
+		left := deadline.Sub(r.clock.Now())
+		if left <= 0 {
+			return
+		}
+		r.sleep(min(left, r.duration(WaitStep)))
+	}
+}
+
+func (r *Runner) delay(item service.ProfileTemplateItem) {
+	if item.DelayMilliseconds > 0 {
+		r.sleep(time.Millisecond * time.Duration(item.DelayMilliseconds))
+	}
+}
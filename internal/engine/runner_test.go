@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+	"github.com/gibgibik/go-lineage2-macros/internal/service"
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+	"go.uber.org/zap"
+)
+
+// fakeStats always reports the same player stat as just received.
+type fakeStats struct {
+	stat entity.PlayerStat
+}
+
+func (s fakeStats) PlayerStat(pid uint32) *entity.PlayerStat {
+	stat := s.stat
+	return &stat
+}
+
+func (s fakeStats) Party() map[uint8]entity.PartyMember {
+	return nil
+}
+
+func (s fakeStats) ReceivedAt(pid uint32) time.Time {
+	return time.Time{}
+}
+
+func (s fakeStats) History(pid uint32, now time.Time) []service.StatSample {
+	return nil
+}
+
+// keyPress is a chord as sent to the control device.
+type keyPress struct {
+	Modifier byte
+	Keys     string
+}
+
+// runProfile writes the profile to var/profiles of a temporary directory, runs it until it stops
+// by itself and returns the chords sent. The profile must end with a /stop item.
+func runProfile(t *testing.T, clock *fakeClock, settings Settings, profile service.ProfileTemplate) []keyPress {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("var/profiles", 0700); err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("var/profiles/"+profile.Profile+".json", body, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var trace bytes.Buffer
+	server := service.NewFakeServerClient()
+	r := NewRunner(100, TypeMain, fakeStats{stat: entity.PlayerStat{HP: entity.Stat{Percent: 80}}}, server, clock, settings)
+	if err := r.Start(context.Background(), profile.Profile, service.NewRecordingControlWriter(&trace), nil, zap.NewNop().Sugar()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Running() {
+		if time.Now().After(deadline) {
+			r.Stop()
+			t.Fatal("runner didn't reach its /stop item")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status := r.Status(); status.State != StateStopped {
+		t.Fatalf("status = %+v, want stopped", status)
+	}
+
+	var presses []keyPress
+	scanner := bufio.NewScanner(&trace)
+	for scanner.Scan() {
+		var event service.InputEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != service.InputEventSendKeys {
+			continue
+		}
+		keys := ""
+		for _, key := range event.Keys {
+			keys += key
+		}
+		presses = append(presses, keyPress{Modifier: event.Modifier, Keys: keys})
+	}
+	return presses
+}
+
+// fixedTiming makes every wait of the runner predictable.
+func fixedTiming() Timing {
+	return Timing{Waits: map[string]Range{
+		WaitTick:      Fixed(250 * time.Millisecond),
+		WaitActionGap: Fixed(10 * time.Millisecond),
+		WaitKeyTap:    Fixed(50 * time.Millisecond),
+		WaitStep:      Fixed(50 * time.Millisecond),
+	}}
+}
+
+func TestRunnerSendsProfileBindings(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	timing := fixedTiming()
+	timing.Actions = map[string]map[string]Range{service.ActionStop: {WaitStop: Fixed(time.Second)}}
+
+	presses := runProfile(t, clock, Settings{Timing: timing}, service.ProfileTemplate{
+		Profile: "bindings",
+		Items: []service.ProfileTemplateItem{
+			{Action: service.ActionPress, Binding: "1"},
+			{Action: service.ActionPress, Binding: "shift+2", Expression: "my_hp > 50"},
+			{Action: service.ActionPress, Binding: "3", Expression: "my_hp < 50"},
+			{Action: service.ActionPress, Binding: "ctrl+4,5"},
+			{Action: service.ActionStop, Binding: "6", PeriodMilliseconds: 1},
+		},
+	})
+
+	want := []keyPress{
+		{Keys: "1"},
+		{Modifier: ch9329.ModLeftShift, Keys: "2"},
+		{Modifier: ch9329.ModLeftCtrl, Keys: "4"},
+		{Keys: "5"},
+		{Keys: "6"},
+	}
+	if !reflect.DeepEqual(presses, want) {
+		t.Errorf("presses = %+v, want %+v", presses, want)
+	}
+	// 5 taps, the step between the chords of "ctrl+4,5", the gaps after the 3 pressed items
+	// and the wait of /stop, which doesn't leave a gap
+	wantElapsed := 5*50*time.Millisecond + 50*time.Millisecond + 3*10*time.Millisecond + time.Second
+	if elapsed := clock.Now().Sub(start); elapsed != wantElapsed {
+		t.Errorf("elapsed = %s, want %s", elapsed, wantElapsed)
+	}
+}
+
+func TestRunnerRespectsItemPeriod(t *testing.T) {
+	clock := newFakeClock()
+	presses := runProfile(t, clock, Settings{Timing: fixedTiming()}, service.ProfileTemplate{
+		Profile: "period",
+		Items: []service.ProfileTemplateItem{
+			{Action: service.ActionPress, Binding: "1", PeriodMilliseconds: 1000},
+			{Action: service.ActionPress, Binding: "2"},
+			{Action: service.ActionStop, Binding: "3", PeriodMilliseconds: 2500},
+		},
+	})
+
+	counts := make(map[string]int)
+	for _, press := range presses {
+		counts[press.Keys]++
+	}
+	// a cycle pressing both items takes 370ms and 310ms when "1" isn't due, so "1" is pressed at
+	// 0, 1300 and 2600ms of the fake clock and "2" in each of the 9 cycles up to /stop
+	want := map[string]int{"1": 3, "2": 9, "3": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("presses by key = %v, want %v", counts, want)
+	}
+}
+
+func TestRunnerTimingIsReproducible(t *testing.T) {
+	settings := Settings{Timing: Timing{
+		Seed:  42,
+		Waits: map[string]Range{WaitTick: {Min: 100 * time.Millisecond, Max: 400 * time.Millisecond}},
+	}}
+	profile := service.ProfileTemplate{
+		Profile: "seeded",
+		Items: []service.ProfileTemplateItem{
+			{Action: service.ActionPress, Binding: "1"},
+			{Action: service.ActionStop, Binding: "2", PeriodMilliseconds: 3000},
+		},
+	}
+
+	run := func() (time.Duration, int) {
+		clock := newFakeClock()
+		start := clock.Now()
+		presses := runProfile(t, clock, settings, profile)
+		return clock.Now().Sub(start), len(presses)
+	}
+	firstElapsed, firstPresses := run()
+	secondElapsed, secondPresses := run()
+	if firstElapsed != secondElapsed || firstPresses != secondPresses {
+		t.Errorf("runs with the same seed differ: %s with %d presses, then %s with %d presses",
+			firstElapsed, firstPresses, secondElapsed, secondPresses)
+	}
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-macros/internal/core"
+)
+
+// Every wait of the engine goes through one of these, the durations come from the timing config.
+const (
+	// WaitTick is the pause between two runs of the stack
+	WaitTick = "tick"
+	// WaitActionGap is the pause after an item was executed
+	WaitActionGap = "action_gap"
+	// WaitKeyTap is how long keys and mouse buttons are held down
+	WaitKeyTap = "key_tap"
+	// WaitStep is the pause between the steps of an action: chords of a sequence, clicks, target checks
+	WaitStep = "step"
+	// WaitMouseMove is the pause between the cursor moves of a drag or the wheel notches of a scroll
+	WaitMouseMove = "mouse_move"
+	// WaitPoll is how often the runner checks again while stats are stale or the device is down
+	WaitPoll = "poll"
+	// WaitSwitchWindow is the pause after the window switch binding was pressed
+	WaitSwitchWindow = "switch_window"
+	// WaitStop is the pause after /stop pressed its binding, before the runner ends
+	WaitStop = "stop"
+	// WaitUnstuck is the pause after the /unstuck click, before its binding is pressed
+	WaitUnstuck = "unstuck"
+)
+
+var defaultWaits = map[string]Range{
+	WaitTick:         {Min: time.Millisecond * 200, Max: time.Millisecond * 300},
+	WaitActionGap:    {Min: time.Millisecond * 50, Max: time.Millisecond * 100},
+	WaitKeyTap:       Fixed(time.Millisecond * 50),
+	WaitStep:         Fixed(time.Millisecond * 50),
+	WaitMouseMove:    Fixed(time.Millisecond * 10),
+	WaitPoll:         Fixed(time.Millisecond * 500),
+	WaitSwitchWindow: Fixed(time.Millisecond * 200),
+	WaitStop:         Fixed(time.Second * 10),
+	WaitUnstuck:      Fixed(time.Second * 3),
+}
+
+// Range is a random duration between Min and Max, both included.
+type Range struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func Fixed(d time.Duration) Range {
+	return Range{Min: d, Max: d}
+}
+
+func (rg Range) Pick(rnd *rand.Rand) time.Duration {
+	if rg.Max <= rg.Min {
+		return rg.Min
+	}
+	return rg.Min + time.Duration(rnd.Int64N(int64(rg.Max-rg.Min)+1))
+}
+
+// Timing holds the waits by name, the zero value uses the defaults.
+type Timing struct {
+	// Seed makes the random durations reproducible, 0 picks a random one for every runner
+	Seed    uint64
+	Waits   map[string]Range
+	Actions map[string]map[string]Range
+}
+
+// NewTiming converts the timing config, the waits it doesn't set keep their defaults.
+func NewTiming(cnf core.Timing) (Timing, error) {
+	timing := Timing{
+		Seed:    uint64(cnf.Seed),
+		Waits:   make(map[string]Range, len(cnf.Waits)),
+		Actions: make(map[string]map[string]Range, len(cnf.Actions)),
+	}
+	for name, val := range cnf.Waits {
+		rg, err := newRange(name, val)
+		if err != nil {
+			return timing, err
+		}
+		timing.Waits[name] = rg
+	}
+	for action, waits := range cnf.Actions {
+		timing.Actions[action] = make(map[string]Range, len(waits))
+		for name, val := range waits {
+			rg, err := newRange(name, val)
+			if err != nil {
+				return timing, fmt.Errorf("%s: %w", action, err)
+			}
+			timing.Actions[action][name] = rg
+		}
+	}
+	return timing, nil
+}
+
+// Range returns the wait of the action, falling back to the global one and then to the default.
+func (t Timing) Range(action string, name string) Range {
+	if rg, ok := t.Actions[action][name]; ok {
+		return rg
+	}
+	if rg, ok := t.Waits[name]; ok {
+		return rg
+	}
+	return defaultWaits[name]
+}
+
+func newRange(name string, val []int) (Range, error) {
+	if _, ok := defaultWaits[name]; !ok {
+		return Range{}, fmt.Errorf("unknown wait %q", name)
+	}
+	var rg Range
+	switch len(val) {
+	case 1:
+		rg = Fixed(time.Duration(val[0]) * time.Millisecond)
+	case 2:
+		rg = Range{Min: time.Duration(val[0]) * time.Millisecond, Max: time.Duration(val[1]) * time.Millisecond}
+	default:
+		return rg, fmt.Errorf("wait %q expects [min, max] or a single value", name)
+	}
+	if rg.Min < 0 || rg.Max < rg.Min {
+		return rg, fmt.Errorf("wait %q has an invalid range %v", name, val)
+	}
+	return rg, nil
+}
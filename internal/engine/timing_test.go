@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-macros/internal/core"
+)
+
+func TestNewTiming(t *testing.T) {
+	tests := []struct {
+		name   string
+		cnf    core.Timing
+		action string
+		wait   string
+		want   Range
+		err    string
+	}{
+		{name: "default", wait: WaitTick, want: Range{Min: 200 * time.Millisecond, Max: 300 * time.Millisecond}},
+		{name: "fixed", cnf: core.Timing{Waits: map[string][]int{WaitTick: {100}}}, wait: WaitTick, want: Fixed(100 * time.Millisecond)},
+		{name: "range", cnf: core.Timing{Waits: map[string][]int{WaitStep: {20, 80}}}, wait: WaitStep, want: Range{Min: 20 * time.Millisecond, Max: 80 * time.Millisecond}},
+		{
+			name:   "action override",
+			cnf:    core.Timing{Waits: map[string][]int{WaitStep: {20}}, Actions: map[string]map[string][]int{"/pickup": {WaitStep: {100, 150}}}},
+			action: "/pickup",
+			wait:   WaitStep,
+			want:   Range{Min: 100 * time.Millisecond, Max: 150 * time.Millisecond},
+		},
+		{
+			name:   "other action keeps the global wait",
+			cnf:    core.Timing{Waits: map[string][]int{WaitStep: {20}}, Actions: map[string]map[string][]int{"/pickup": {WaitStep: {100, 150}}}},
+			action: "/press",
+			wait:   WaitStep,
+			want:   Fixed(20 * time.Millisecond),
+		},
+		{name: "unknown wait", cnf: core.Timing{Waits: map[string][]int{"nap": {100}}}, err: `unknown wait "nap"`},
+		{name: "unknown action wait", cnf: core.Timing{Actions: map[string]map[string][]int{"/pickup": {"nap": {100}}}}, err: `/pickup: unknown wait "nap"`},
+		{name: "too many values", cnf: core.Timing{Waits: map[string][]int{WaitTick: {1, 2, 3}}}, err: "expects [min, max]"},
+		{name: "min above max", cnf: core.Timing{Waits: map[string][]int{WaitTick: {300, 200}}}, err: "invalid range"},
+		{name: "negative", cnf: core.Timing{Waits: map[string][]int{WaitTick: {-1}}}, err: "invalid range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timing, err := NewTiming(tt.cnf)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := timing.Range(tt.action, tt.wait); got != tt.want {
+				t.Errorf("Range(%q, %q) = %+v, want %+v", tt.action, tt.wait, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangePick(t *testing.T) {
+	rg := Range{Min: 100 * time.Millisecond, Max: 110 * time.Millisecond}
+	first := rand.New(rand.NewPCG(1, 2))
+	second := rand.New(rand.NewPCG(1, 2))
+	for range 100 {
+		d := rg.Pick(first)
+		if d < rg.Min || d > rg.Max {
+			t.Fatalf("Pick = %s, want within [%s, %s]", d, rg.Min, rg.Max)
+		}
+		if other := rg.Pick(second); other != d {
+			t.Fatalf("Pick with the same seed = %s, then %s", d, other)
+		}
+	}
+	if d := Fixed(time.Second).Pick(first); d != time.Second {
+		t.Errorf("fixed Pick = %s, want 1s", d)
+	}
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WatchdogSettings tune the watchdog, a zero RecoverAfter only reports the stuck runners.
+type WatchdogSettings struct {
+	// StuckAfter is how long a running, not paused runner may go without progress
+	StuckAfter time.Duration
+	// RecoverAfter is how long a runner may stay stuck before it's force stopped
+	RecoverAfter time.Duration
+	Interval     time.Duration
+}
+
+// StuckRunner describes a runner which made no progress for longer than StuckAfter.
+type StuckRunner struct {
+	Pid       uint32    `json:"pid"`
+	Since     time.Time `json:"since"`
+	Where     string    `json:"where"`
+	Recovered bool      `json:"recovered"`
+}
+
+// Watchdog reports runners which stopped making progress, e.g. blocked on a device or a server
+// request, and force stops them so the runners sharing their device aren't blocked too.
+type Watchdog struct {
+	clock    Clock
+	settings WatchdogSettings
+	logger   *zap.SugaredLogger
+	mutex    sync.Mutex
+	stuck    map[uint32]StuckRunner
+}
+
+func NewWatchdog(clock Clock, settings WatchdogSettings, logger *zap.SugaredLogger) *Watchdog {
+	if settings.Interval <= 0 {
+		settings.Interval = time.Second
+	}
+	return &Watchdog{
+		clock:    clock,
+		settings: settings,
+		logger:   logger,
+		stuck:    make(map[uint32]StuckRunner),
+	}
+}
+
+// Run checks the runners every interval until ctx is done.
+func (w *Watchdog) Run(ctx context.Context, runners func() []*Runner) {
+	if w.settings.StuckAfter <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.clock.After(w.settings.Interval):
+			w.Check(runners())
+		}
+	}
+}
+
+// Check updates the stuck runners list and recovers the runners stuck for longer than RecoverAfter.
+func (w *Watchdog) Check(runners []*Runner) {
+	now := w.clock.Now()
+	seen := make(map[uint32]bool, len(runners))
+	for _, runner := range runners {
+		seen[runner.Pid()] = true
+		beatAt, where := runner.Heartbeat()
+		if !runner.Running() || runner.Paused() || now.Sub(beatAt) <= w.settings.StuckAfter {
+			w.clear(runner.Pid())
+			continue
+		}
+		stuck, known := w.get(runner.Pid())
+		if !known {
+			stuck = StuckRunner{Pid: runner.Pid(), Since: beatAt, Where: where}
+			w.logger.Warnf("runner %d is stuck at %s since %s", runner.Pid(), where, beatAt.Format(time.TimeOnly))
+		}
+		if !stuck.Recovered && w.settings.RecoverAfter > 0 && now.Sub(beatAt) > w.settings.StuckAfter+w.settings.RecoverAfter {
+			stuck.Recovered = true
+			if runner.ForceStop(time.Second) {
+				w.logger.Warnf("runner %d was force stopped", runner.Pid())
+			} else {
+				w.logger.Errorf("runner %d didn't stop, its foreground was released", runner.Pid())
+			}
+		}
+		w.set(stuck)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for pid := range w.stuck {
+		if !seen[pid] {
+			delete(w.stuck, pid)
+		}
+	}
+}
+
+// Stuck returns the runners stuck at the last check, by PID.
+func (w *Watchdog) Stuck() []StuckRunner {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	result := make([]StuckRunner, 0, len(w.stuck))
+	for _, stuck := range w.stuck {
+		result = append(result, stuck)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Pid < result[j].Pid
+	})
+	return result
+}
+
+func (w *Watchdog) get(pid uint32) (StuckRunner, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	stuck, ok := w.stuck[pid]
+	return stuck, ok
+}
+
+func (w *Watchdog) set(stuck StuckRunner) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stuck[stuck.Pid] = stuck
+}
+
+func (w *Watchdog) clear(pid uint32) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.stuck[pid]; ok {
+		delete(w.stuck, pid)
+		w.logger.Infof("runner %d is no longer stuck", pid)
+	}
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeClock never sleeps, After moves the time forward by d and fires at once.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.Advance(d)
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// newRunningRunner returns a runner which looks running to the watchdog without its run goroutine.
+func newRunningRunner(clock Clock) *Runner {
+	r := NewRunner(1, TypeMain, nil, nil, clock, Settings{})
+	ctx, cancel := context.WithCancel(context.Background())
+	r.ctx = ctx
+	r.logger = zap.NewNop().Sugar()
+	r.handle = &runHandle{cancel: cancel, done: make(chan struct{})}
+	r.current.Store(r.handle)
+	r.beat("start")
+	return r
+}
+
+func newTestWatchdog(clock Clock) *Watchdog {
+	return NewWatchdog(clock, WatchdogSettings{StuckAfter: time.Minute}, zap.NewNop().Sugar())
+}
+
+func TestWatchdogIgnoresLongSleep(t *testing.T) {
+	clock := newFakeClock()
+	r := newRunningRunner(clock)
+	w := newTestWatchdog(clock)
+
+	r.sleep(90 * time.Second)
+	w.Check([]*Runner{r})
+	if stuck := w.Stuck(); len(stuck) != 0 {
+		t.Fatalf("runner reported stuck right after a 90s sleep: %+v", stuck)
+	}
+
+	clock.Advance(61 * time.Second)
+	w.Check([]*Runner{r})
+	if stuck := w.Stuck(); len(stuck) != 1 {
+		t.Fatalf("runner not reported stuck 61s after its sleep ended: %+v", stuck)
+	}
+}
+
+func TestWatchdogIgnoresLongHold(t *testing.T) {
+	clock := newFakeClock()
+	r := newRunningRunner(clock)
+	w := newTestWatchdog(clock)
+	start := clock.Now()
+
+	checked := false
+	r.holdUntil(90*time.Second, func() bool {
+		if clock.Now().Sub(start) >= 75*time.Second && !checked {
+			checked = true
+			w.Check([]*Runner{r})
+		}
+		return false
+	})
+	if !checked {
+		t.Fatal("hold ended before the watchdog check")
+	}
+	if stuck := w.Stuck(); len(stuck) != 0 {
+		t.Fatalf("runner reported stuck while holding: %+v", stuck)
+	}
+}
+
+func TestWatchdogRecoversRunnerStayingStuck(t *testing.T) {
+	clock := newFakeClock()
+	r := newRunningRunner(clock)
+	w := NewWatchdog(clock, WatchdogSettings{StuckAfter: time.Minute, RecoverAfter: time.Minute}, zap.NewNop().Sugar())
+
+	// the run goroutine is blocked, e.g. in a device write, it never closes done
+	clock.Advance(2*time.Minute + time.Second)
+	w.Check([]*Runner{r})
+	if stuck := w.Stuck(); len(stuck) != 1 || !stuck[0].Recovered {
+		t.Fatalf("stuck runners = %+v, want the runner recovered", stuck)
+	}
+	if r.Running() {
+		t.Fatal("runner still running after the recovery")
+	}
+	if status := r.Status(); status.State != StateError {
+		t.Errorf("status = %+v, want the force stop error", status)
+	}
+
+	// once unblocked, the abandoned run leaves the shared state alone
+	beatAt, _ := r.Heartbeat()
+	clock.Advance(time.Second)
+	r.beat("abandoned")
+	if at, where := r.Heartbeat(); !at.Equal(beatAt) || where == "abandoned" {
+		t.Errorf("abandoned run moved the heartbeat to %s at %s", where, at)
+	}
+	w.Check([]*Runner{r})
+	if stuck := w.Stuck(); len(stuck) != 0 {
+		t.Errorf("stopped runner still reported stuck: %+v", stuck)
+	}
+
+	if err := r.Start(context.Background(), "watchdog-test-missing-profile", nil, nil, zap.NewNop().Sugar()); err != nil {
+		t.Fatalf("Start after the recovery = %v", err)
+	}
+	r.Stop()
+}
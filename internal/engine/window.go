@@ -0,0 +1,66 @@
+package engine
+
+// switchWindowAttempts bounds the window switch presses, each one brings the next window up.
+const switchWindowAttempts = 8
+
+// acquireForeground waits for the arbiter to grant the shared device to the runner, with the priority
+// of the current item, and brings its window up before any input is sent.
+func (r *Runner) acquireForeground() error {
+	if r.arbiter == nil || r.runnerType == TypeDedicated {
+		return nil
+	}
+	r.waitingForeground.Store(true)
+	err := r.arbiter.Acquire(r.ctx, r.pid, r.priority)
+	r.waitingForeground.Store(false)
+	if err != nil {
+		return err
+	}
+	if !r.windowSwitched {
+		r.windowSwitched = true
+		_ = r.switchWindow(r.pid)
+	}
+	return nil
+}
+
+// releaseForeground lets the arbiter grant the device to the next runner.
+func (r *Runner) releaseForeground() {
+	// ForceStop released the foreground of an abandoned run, it may be held by the next run already
+	if r.arbiter == nil || r.abandoned() {
+		return
+	}
+	r.windowSwitched = false
+	r.arbiter.Release(r.pid)
+}
+
+// yieldForeground releases the device between items when a runner with a higher priority waits for it.
+func (r *Runner) yieldForeground() {
+	if r.windowSwitched && r.arbiter.Preempted(r.pid) {
+		r.logger.Debug("foreground preempted")
+		r.releaseForeground()
+	}
+}
+
+func (r *Runner) switchWindow(pid uint32) bool {
+	curPid, err := serverRequest(r, r.server.GetForegroundWindowPid)
+	if err != nil {
+		r.logger.Errorf("get foreground window failed: %v", err)
+		return false
+	}
+	for attempt := 0; curPid != 0 && curPid != pid && attempt < switchWindowAttempts; attempt++ {
+		if r.control == nil {
+			break
+		}
+		r.pressKey("\\")
+		r.wait(WaitSwitchWindow)
+		curPid, err = serverRequest(r, r.server.GetForegroundWindowPid)
+		if err != nil {
+			r.logger.Errorf("get foreground window failed: %v", err)
+			return false
+		}
+	}
+	if curPid != 0 && curPid != pid {
+		r.logger.Errorf("alt tab failed, current pid is %d, window is %d", curPid, pid)
+		return false
+	}
+	return true
+}
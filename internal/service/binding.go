@@ -0,0 +1,115 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+)
+
+const (
+	bindingSequenceSeparator = ','
+	bindingChordSeparator    = '+'
+)
+
+var bindingModifiers = map[string]byte{
+	"ctrl":    ch9329.ModLeftCtrl,
+	"control": ch9329.ModLeftCtrl,
+	"shift":   ch9329.ModLeftShift,
+	"alt":     ch9329.ModLeftAlt,
+	"meta":    ch9329.ModLeftWindows,
+	"win":     ch9329.ModLeftWindows,
+	"rctrl":   ch9329.ModRightCtrl,
+	"rshift":  ch9329.ModRightShift,
+	"ralt":    ch9329.ModRightAlt,
+	"rmeta":   ch9329.ModRightWindows,
+}
+
+// KeyChord is pressed at once: the modifiers and all the keys are sent in one keyboard report.
+// A chord may be made of modifiers only, e.g. "shift+shift" as the web UI records the shift key alone.
+type KeyChord struct {
+	Modifier byte
+	Keys     []string
+}
+
+// KeyBinding is a sequence of chords pressed one after another.
+type KeyBinding []KeyChord
+
+// ParseBinding converts a binding as recorded by the web UI, e.g. "ctrl+shift+f1" or "f1,f2,f3", into
+// CH9329 modifier bytes and keys. Chords may have up to 6 keys, e.g. "shift+a+b". A separator where
+// a key is expected is the key itself, so "shift+,", "ctrl++" and "+,," bind the comma and plus keys.
+// A key name outside the keyboard report tables is left to the CH9329 library mapping, as bindings
+// were before chords existed, so it must be the only key of its chord.
+func ParseBinding(binding string) (KeyBinding, error) {
+	binding = strings.ToLower(binding)
+	if strings.TrimSpace(binding) == "" && binding != " " {
+		return nil, errors.New("empty binding")
+	}
+	var result KeyBinding
+	var chord KeyChord
+	finishChord := func() error {
+		if len(chord.Keys) == 0 && chord.Modifier == 0 {
+			return errors.New("chord without a key")
+		}
+		if len(chord.Keys) > keyboardReportKeys {
+			return fmt.Errorf("at most %d keys can be pressed at once", keyboardReportKeys)
+		}
+		for _, key := range chord.Keys {
+			if len(chord.Keys) > 1 && !hidKey(key) {
+				return fmt.Errorf("unknown key %q can't be pressed with other keys", key)
+			}
+		}
+		result = append(result, chord)
+		chord = KeyChord{}
+		return nil
+	}
+	for pos := 0; ; {
+		token := readBindingToken(binding, pos)
+		pos += len(token)
+		token = trimBindingSpace(token)
+		if modifier, ok := bindingModifiers[token]; ok {
+			chord.Modifier |= modifier
+		} else {
+			chord.Keys = append(chord.Keys, token)
+		}
+		if pos >= len(binding) {
+			break
+		}
+		separator := binding[pos]
+		pos++
+		if separator == bindingSequenceSeparator {
+			if err := finishChord(); err != nil {
+				return nil, fmt.Errorf("binding %q: %w", binding, err)
+			}
+		}
+		if pos >= len(binding) {
+			return nil, fmt.Errorf("binding %q ends with %q", binding, separator)
+		}
+	}
+	if err := finishChord(); err != nil {
+		return nil, fmt.Errorf("binding %q: %w", binding, err)
+	}
+	return result, nil
+}
+
+// readBindingToken reads the key or modifier at pos, up to the next separator. A separator at pos
+// is read as the key of the same name.
+func readBindingToken(binding string, pos int) string {
+	if c := binding[pos]; c == bindingSequenceSeparator || c == bindingChordSeparator {
+		return binding[pos : pos+1]
+	}
+	end := strings.IndexAny(binding[pos:], string([]byte{bindingSequenceSeparator, bindingChordSeparator}))
+	if end < 0 {
+		return binding[pos:]
+	}
+	return binding[pos : pos+end]
+}
+
+// trimBindingSpace keeps a lone space, it's the space key as recorded by the web UI.
+func trimBindingSpace(s string) string {
+	if trimmed := strings.TrimSpace(s); trimmed != "" {
+		return trimmed
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+)
+
+func TestParseBinding(t *testing.T) {
+	tests := []struct {
+		binding string
+		want    KeyBinding
+	}{
+		{"f1", KeyBinding{{Keys: []string{"f1"}}}},
+		{"CTRL+Shift+F1", KeyBinding{{Modifier: ch9329.ModLeftCtrl | ch9329.ModLeftShift, Keys: []string{"f1"}}}},
+		{"f1,f2, f3", KeyBinding{{Keys: []string{"f1"}}, {Keys: []string{"f2"}}, {Keys: []string{"f3"}}}},
+		{"shift+a+b", KeyBinding{{Modifier: ch9329.ModLeftShift, Keys: []string{"a", "b"}}}},
+		{"shift+,", KeyBinding{{Modifier: ch9329.ModLeftShift, Keys: []string{","}}}},
+		{"ctrl++", KeyBinding{{Modifier: ch9329.ModLeftCtrl, Keys: []string{"+"}}}},
+		{"ctrl++,a", KeyBinding{{Modifier: ch9329.ModLeftCtrl, Keys: []string{"+"}}, {Keys: []string{"a"}}}},
+		{"a,,,b", KeyBinding{{Keys: []string{"a"}}, {Keys: []string{","}}, {Keys: []string{"b"}}}},
+		{"+", KeyBinding{{Keys: []string{"+"}}}},
+		{",", KeyBinding{{Keys: []string{","}}}},
+		{" ", KeyBinding{{Keys: []string{" "}}}},
+		{"ctrl+ ", KeyBinding{{Modifier: ch9329.ModLeftCtrl, Keys: []string{" "}}}},
+		{"ralt+esc", KeyBinding{{Modifier: ch9329.ModRightAlt, Keys: []string{"esc"}}}},
+		{"f24", KeyBinding{{Keys: []string{"f24"}}}},
+		// the forms the web UI records, see onChangeBinding
+		{"esc", KeyBinding{{Keys: []string{"esc"}}}},
+		{"shift+escape", KeyBinding{{Modifier: ch9329.ModLeftShift, Keys: []string{"escape"}}}},
+		{"ctrl+arrowleft", KeyBinding{{Modifier: ch9329.ModLeftCtrl, Keys: []string{"arrowleft"}}}},
+		{"alt+enter", KeyBinding{{Modifier: ch9329.ModLeftAlt, Keys: []string{"enter"}}}},
+		{"shift+!", KeyBinding{{Modifier: ch9329.ModLeftShift, Keys: []string{"!"}}}},
+		{"ctrl+shift+a", KeyBinding{{Modifier: ch9329.ModLeftCtrl | ch9329.ModLeftShift, Keys: []string{"a"}}}},
+		{"meta+contextmenu", KeyBinding{{Modifier: ch9329.ModLeftWindows, Keys: []string{"contextmenu"}}}},
+		{"ctrl+control", KeyBinding{{Modifier: ch9329.ModLeftCtrl}}},
+		{"shift+shift", KeyBinding{{Modifier: ch9329.ModLeftShift}}},
+		{"alt+alt", KeyBinding{{Modifier: ch9329.ModLeftAlt}}},
+		{"meta+meta", KeyBinding{{Modifier: ch9329.ModLeftWindows}}},
+		{"\\", KeyBinding{{Keys: []string{"\\"}}}},
+		// names outside the report tables are left to the CH9329 library
+		{"audiovolumeup", KeyBinding{{Keys: []string{"audiovolumeup"}}}},
+		{"ctrl+f25", KeyBinding{{Modifier: ch9329.ModLeftCtrl, Keys: []string{"f25"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.binding, func(t *testing.T) {
+			got, err := ParseBinding(tt.binding)
+			if err != nil {
+				t.Fatalf("ParseBinding(%q) error: %v", tt.binding, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseBinding(%q) = %+v, want %+v", tt.binding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBindingErrors(t *testing.T) {
+	for _, binding := range []string{"", "a+", "a,", "a+b+c+d+e+f+g", "a+foo", "ctrl+f25+b"} {
+		t.Run(binding, func(t *testing.T) {
+			if got, err := ParseBinding(binding); err == nil {
+				t.Errorf("ParseBinding(%q) = %+v, expected an error", binding, got)
+			}
+		})
+	}
+}
+
+func TestKeyboardReport(t *testing.T) {
+	modifier, codes, err := KeyboardReport(ch9329.ModLeftCtrl, []string{"a", "+", "f1"})
+	if err != nil {
+		t.Fatalf("KeyboardReport error: %v", err)
+	}
+	if modifier != ch9329.ModLeftCtrl|ch9329.ModLeftShift {
+		t.Errorf("modifier = %#x, want ctrl and shift", modifier)
+	}
+	if want := [keyboardReportKeys]byte{0x04, 0x2e, 0x3a}; codes != want {
+		t.Errorf("codes = %#v, want %#v", codes, want)
+	}
+}
+
+func TestKeyboardReportAliases(t *testing.T) {
+	for alias, key := range map[string]string{"escape": "esc", "arrowup": "up", "return": "enter", "del": "delete", "spacebar": " "} {
+		_, aliasCodes, aliasErr := KeyboardReport(0, []string{alias})
+		_, keyCodes, keyErr := KeyboardReport(0, []string{key})
+		if aliasErr != nil || keyErr != nil || aliasCodes != keyCodes {
+			t.Errorf("KeyboardReport(%q) = %v, %v, want the report of %q", alias, aliasCodes, aliasErr, key)
+		}
+	}
+}
+
+func TestCh9329Frame(t *testing.T) {
+	// releasing all the keys, as in the CH9329 protocol examples
+	got := ch9329Frame(ch9329CmdKeyboard, make([]byte, 8))
+	want := []byte{0x57, 0xab, 0x00, 0x02, 0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0x0c}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ch9329Frame = % x, want % x", got, want)
+	}
+}
@@ -2,115 +2,380 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gibgibik/go-lineage2-server/pkg/entity"
 	"go.uber.org/zap"
 )
 
-func CheckCondition(conditionsCombinator string, conditions []Condition, stat *entity.PlayerStat, party map[uint8]entity.PartyMember, logger *zap.SugaredLogger) (bool, error) {
-	if stat == nil {
+// ConditionEnv is the state conditions are evaluated against.
+type ConditionEnv struct {
+	Stat  *entity.PlayerStat
+	Party map[uint8]entity.PartyMember
+	// Previous stats are used by the percent change operators, they may be nil.
+	PreviousStat  *entity.PlayerStat
+	PreviousParty map[uint8]entity.PartyMember
+	// History holds the recent samples for the rate of change fields, oldest first
+	History   []StatSample
+	Variables map[string]float64
+	Now       time.Time
+	// Random is used by the random value source, the global source is used when nil
+	Random *rand.Rand
+	// State keeps the sustained and hysteresis tracking of one profile item, modifiers are ignored when nil
+	State *ConditionState
+}
+
+type conditionField func(env ConditionEnv) (float64, bool)
+
+type conditionOperator struct {
+	args  int
+	check func(val float64, args []float64) bool
+}
+
+const (
+	OperatorRoseByPercent = "rose_by_pct"
+	OperatorFellByPercent = "fell_by_pct"
+
+	ValueSourceLiteral  = "literal"
+	ValueSourceStat     = "stat"
+	ValueSourceVariable = "variable"
+	ValueSourceRandom   = "random"
+	// react-querybuilder names for the literal and stat sources
+	valueSourceQueryBuilderValue = "value"
+	valueSourceQueryBuilderField = "field"
+)
+
+var (
+	conditionFields = map[string]conditionField{
+		"target_hp": func(env ConditionEnv) (float64, bool) {
+			return env.Stat.Target.HpPercent, true
+		},
+		"my_hp": func(env ConditionEnv) (float64, bool) {
+			return env.Stat.HP.Percent, env.Stat.HP.Percent > 0
+		},
+		"my_mp": func(env ConditionEnv) (float64, bool) {
+			return env.Stat.MP.Percent, env.Stat.MP.Percent > 0
+		},
+		// milliseconds elapsed
+		"since_last_success_target": func(env ConditionEnv) (float64, bool) {
+			return float64(env.Now.UnixMilli() - env.Stat.Target.HpWasPresentAt), true
+		},
+		"full_target_hp_unchanged_since": func(env ConditionEnv) (float64, bool) {
+			return float64(env.Now.UnixMilli() - env.Stat.Target.FullHpUnchangedSince), true
+		},
+	}
+
+	conditionOperators = map[string]conditionOperator{
+		">":  {1, func(val float64, args []float64) bool { return val > args[0] }},
+		">=": {1, func(val float64, args []float64) bool { return val >= args[0] }},
+		"=":  {1, func(val float64, args []float64) bool { return val == args[0] }},
+		"!=": {1, func(val float64, args []float64) bool { return val != args[0] }},
+		"<":  {1, func(val float64, args []float64) bool { return val < args[0] }},
+		"<=": {1, func(val float64, args []float64) bool { return val <= args[0] }},
+		"between": {2, func(val float64, args []float64) bool {
+			return val >= min(args[0], args[1]) && val <= max(args[0], args[1])
+		}},
+		"outside": {2, func(val float64, args []float64) bool {
+			return val < min(args[0], args[1]) || val > max(args[0], args[1])
+		}},
+		// val is the change in percent since the previous stats
+		OperatorRoseByPercent: {1, func(val float64, args []float64) bool { return val >= args[0] }},
+		OperatorFellByPercent: {1, func(val float64, args []float64) bool { return -val >= args[0] }},
+	}
+
+	// conditionFieldFactories build the fields which take arguments, keyed by the name before the parentheses
+	conditionFieldFactories = map[string]func(args []string) (conditionField, error){}
+)
+
+// lookupConditionField resolves plain fields like "my_hp" and parameterized ones like "party_count_below(hp,50)".
+func lookupConditionField(name string) (conditionField, bool) {
+	name = strings.TrimSpace(name)
+	if field, ok := conditionFields[name]; ok {
+		return field, true
+	}
+	open := strings.IndexByte(name, '(')
+	if open <= 0 || !strings.HasSuffix(name, ")") {
+		return nil, false
+	}
+	factory, ok := conditionFieldFactories[name[:open]]
+	if !ok {
+		return nil, false
+	}
+	args := strings.Split(name[open+1:len(name)-1], ",")
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+	field, err := factory(args)
+	if err != nil {
+		return nil, false
+	}
+	return field, true
+}
+
+// CheckConditionGroup evaluates the group recursively. Conditions without a value are ignored,
+// a group without applicable conditions passes unless it is an OR group.
+func CheckConditionGroup(group *ConditionGroup, env ConditionEnv, logger *zap.SugaredLogger) (bool, error) {
+	if env.Stat == nil {
 		return false, errors.New("empty player stat, please check server")
 	}
-	result := conditionsCombinator != ConditionCombinatorOr
-	for _, condition := range conditions {
-		if condition.Value == "" {
+	if group == nil {
+		return true, nil
+	}
+	result, applicable := checkGroup(group, env, "")
+	if !applicable {
+		return !strings.EqualFold(group.Combinator, ConditionCombinatorOr), nil
+	}
+	return result, nil
+}
+
+// checkGroup evaluates every rule, without short-circuit, so that the modifiers are tracked on each tick.
+func checkGroup(group *ConditionGroup, env ConditionEnv, path string) (result bool, applicable bool) {
+	isOr := strings.EqualFold(group.Combinator, ConditionCombinatorOr)
+	result = !isOr
+	for i, rule := range group.Rules {
+		var val, ok bool
+		rulePath := path + "/" + strconv.Itoa(i)
+		if rule.Group != nil {
+			val, ok = checkGroup(rule.Group, env, rulePath)
+		} else if rule.Condition != nil {
+			val, ok = checkSingleCondition(*rule.Condition, env, rulePath)
+		}
+		if !ok {
 			continue
 		}
-		cval, _ := strconv.ParseFloat(condition.Value, 64)
-		switch condition.Field {
-		case "target_hp":
-			if conditionsCombinator == ConditionCombinatorOr {
-				result = result || checkOperatorCondition(stat.Target.HpPercent, cval, condition.Operator)
-			} else {
-				result = result && checkOperatorCondition(stat.Target.HpPercent, cval, condition.Operator)
-				if !result {
-					return false, nil
-				}
-			}
-		case "my_hp":
-			if conditionsCombinator == ConditionCombinatorOr {
-				result = result || (stat.HP.Percent > 0 && checkOperatorCondition(stat.HP.Percent, cval, condition.Operator))
-			} else {
-				result = result && stat.HP.Percent > 0 && checkOperatorCondition(stat.HP.Percent, cval, condition.Operator)
-				if !result {
-					return false, nil
-				}
-			}
-		case "my_mp":
-			if conditionsCombinator == ConditionCombinatorOr {
-				result = result || (stat.MP.Percent > 0 && checkOperatorCondition(stat.MP.Percent, cval, condition.Operator))
-			} else {
-				result = result && stat.MP.Percent > 0 && checkOperatorCondition(stat.MP.Percent, cval, condition.Operator)
-				if !result {
-					return false, nil
-				}
+		applicable = true
+		if isOr && val {
+			result = true
+		}
+		if !isOr && !val {
+			result = false
+		}
+	}
+	if group.Not {
+		result = !result
+	}
+	return result, applicable
+}
+
+// checkSingleCondition returns false as applicable for conditions which should be ignored.
+func checkSingleCondition(condition Condition, env ConditionEnv, path string) (result bool, applicable bool) {
+	result, applicable = compareCondition(condition, env)
+	if !applicable || env.State == nil {
+		return result, applicable
+	}
+	return env.State.apply(condition, path, result, env), true
+}
+
+func compareCondition(condition Condition, env ConditionEnv) (result bool, applicable bool) {
+	if condition.Value == "" {
+		return false, false
+	}
+	field, ok := lookupConditionField(condition.Field)
+	if !ok {
+		return false, false
+	}
+	args, err := resolveConditionValues(condition, env)
+	if err != nil {
+		return false, true
+	}
+	val, ok := field(env)
+	if !ok {
+		return false, true
+	}
+	if condition.Operator == OperatorRoseByPercent || condition.Operator == OperatorFellByPercent {
+		if env.PreviousStat == nil {
+			return false, true
+		}
+		previous := env
+		previous.Stat, previous.Party = env.PreviousStat, env.PreviousParty
+		prev, ok := field(previous)
+		if !ok || prev == 0 {
+			return false, true
+		}
+		val = (val - prev) / prev * 100
+	}
+	return checkOperatorCondition(val, args, condition.Operator), true
+}
+
+func checkOperatorCondition(item float64, args []float64, operator string) bool {
+	op, ok := conditionOperators[operator]
+	if !ok || len(args) != op.args {
+		return false
+	}
+	return op.check(item, args)
+}
+
+// resolveConditionValues returns the values the field is compared with, according to the value source.
+func resolveConditionValues(condition Condition, env ConditionEnv) ([]float64, error) {
+	switch normalizeValueSource(condition.ValueSource) {
+	case ValueSourceStat:
+		var result []float64
+		for _, name := range splitConditionValue(condition.Value) {
+			field, ok := lookupConditionField(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q", name)
 			}
-		case "since_last_success_target":
-			if conditionsCombinator == ConditionCombinatorOr {
-				result = result || (checkOperatorCondition(float64(time.Now().UnixMilli()-int64(cval)), float64(stat.Target.HpWasPresentAt), condition.Operator))
-			} else {
-				result = result && checkOperatorCondition(float64(time.Now().UnixMilli()-int64(cval)), float64(stat.Target.HpWasPresentAt), condition.Operator)
-				if !result {
-					return false, nil
-				}
+			val, ok := field(env)
+			if !ok {
+				return nil, fmt.Errorf("field %q is not available", name)
 			}
-		case "full_target_hp_unchanged_since":
-			if conditionsCombinator == ConditionCombinatorOr {
-				result = result || (checkOperatorCondition(float64(time.Now().UnixMilli()-int64(cval)), float64(stat.Target.FullHpUnchangedSince), condition.Operator))
-			} else {
-				result = result && checkOperatorCondition(float64(time.Now().UnixMilli()-int64(cval)), float64(stat.Target.FullHpUnchangedSince), condition.Operator)
-				if !result {
-					return false, nil
-				}
+			result = append(result, val)
+		}
+		return result, nil
+	case ValueSourceVariable:
+		var result []float64
+		for _, name := range splitConditionValue(condition.Value) {
+			val, ok := env.Variables[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown variable %q", name)
 			}
-		case "party_member_hp_1":
-			fallthrough
-		case "party_member_hp_2":
-			fallthrough
-		case "party_member_hp_3":
-			fallthrough
-		case "party_member_hp_4":
-			fallthrough
-		case "party_member_hp_5":
-			fallthrough
-		case "party_member_hp_6":
-			fallthrough
-		case "party_member_hp_7":
-			fallthrough
-		case "party_member_hp_8":
-			s := condition.Field
-			memberNum, _ := strconv.ParseUint(s[len(s)-1:], 10, 8)
-			memberNum++ //change count from 0 to 1
-			if conditionsCombinator == ConditionCombinatorOr {
-				if val, ok := party[uint8(memberNum)]; ok {
-					result = result || checkOperatorCondition(val.HP.Percent, cval, condition.Operator)
-				}
-			} else {
-				if val, ok := party[uint8(memberNum)]; ok {
-					result = result && checkOperatorCondition(val.HP.Percent, cval, condition.Operator)
-					if !result {
-						return false, nil
-					}
-				} else {
-					result = false
-				}
+			result = append(result, val)
+		}
+		return result, nil
+	case ValueSourceRandom:
+		bounds, err := parseConditionValues(condition.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(bounds) != 2 {
+			return nil, errors.New("random range expects two values")
+		}
+		random := rand.Float64
+		if env.Random != nil {
+			random = env.Random.Float64
+		}
+		low, high := min(bounds[0], bounds[1]), max(bounds[0], bounds[1])
+		return []float64{low + random()*(high-low)}, nil
+	default:
+		return parseConditionValues(condition.Value)
+	}
+}
+
+func normalizeValueSource(valueSource string) string {
+	switch strings.ToLower(valueSource) {
+	case "", ValueSourceLiteral, valueSourceQueryBuilderValue:
+		return ValueSourceLiteral
+	case ValueSourceStat, valueSourceQueryBuilderField:
+		return ValueSourceStat
+	}
+	return strings.ToLower(valueSource)
+}
+
+// splitConditionValue splits "my_hp,party_count_below(hp,50)" on the commas outside of parentheses.
+func splitConditionValue(value string) []string {
+	var result []string
+	var depth, start int
+	for i, c := range value {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, value[start:i])
+				start = i + 1
 			}
 		}
 	}
+	return append(result, value[start:])
+}
+
+// parseConditionValues parses "40" or "20,60" for the range operators.
+func parseConditionValues(value string) ([]float64, error) {
+	var result []float64
+	for _, piece := range strings.Split(value, ",") {
+		val, err := strconv.ParseFloat(strings.TrimSpace(piece), 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, val)
+	}
 	return result, nil
 }
 
-func checkOperatorCondition(item float64, item2 float64, operator string) bool {
-	switch operator {
-	case ">":
-		return item > item2
-	case "=":
-		return item == item2
-	case "<":
-		return item < item2
+// ValidateConditionGroup rejects operators and values the engine can't evaluate.
+func ValidateConditionGroup(group *ConditionGroup, variables map[string]float64) error {
+	if group == nil {
+		return nil
+	}
+	for _, rule := range group.Rules {
+		if rule.Group != nil {
+			if err := ValidateConditionGroup(rule.Group, variables); err != nil {
+				return err
+			}
+			continue
+		}
+		if rule.Condition == nil {
+			continue
+		}
+		if err := validateCondition(*rule.Condition, variables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCondition(condition Condition, variables map[string]float64) error {
+	if _, ok := lookupConditionField(condition.Field); !ok {
+		return fmt.Errorf("unknown field %q", condition.Field)
+	}
+	op, ok := conditionOperators[condition.Operator]
+	if !ok {
+		return fmt.Errorf("unsupported operator %q for %s", condition.Operator, condition.Field)
+	}
+	if condition.Value == "" {
+		return nil
+	}
+	var count int
+	switch normalizeValueSource(condition.ValueSource) {
+	case ValueSourceLiteral:
+		args, err := parseConditionValues(condition.Value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", condition.Value, condition.Field, err)
+		}
+		count = len(args)
+	case ValueSourceStat:
+		for _, name := range splitConditionValue(condition.Value) {
+			if _, ok := lookupConditionField(name); !ok {
+				return fmt.Errorf("unknown field %q in value of %s", name, condition.Field)
+			}
+			count++
+		}
+	case ValueSourceVariable:
+		for _, name := range splitConditionValue(condition.Value) {
+			if _, ok := variables[strings.TrimSpace(name)]; !ok {
+				return fmt.Errorf("unknown variable %q in value of %s", name, condition.Field)
+			}
+			count++
+		}
+	case ValueSourceRandom:
+		bounds, err := parseConditionValues(condition.Value)
+		if err != nil || len(bounds) != 2 {
+			return fmt.Errorf("random value of %s expects a range like 40,60", condition.Field)
+		}
+		count = 1
 	default:
-		panic("unsupported operator: " + operator)
+		return fmt.Errorf("unsupported value source %q for %s", condition.ValueSource, condition.Field)
+	}
+	if count != op.args {
+		return fmt.Errorf("operator %q for %s expects %d values, got %d", condition.Operator, condition.Field, op.args, count)
+	}
+	if condition.ForMilliseconds < 0 {
+		return fmt.Errorf("negative duration for %s", condition.Field)
+	}
+	if condition.UntilOperator != "" || condition.UntilValue != "" {
+		until := condition.until()
+		if until.Value == "" {
+			return fmt.Errorf("missing until value for %s", condition.Field)
+		}
+		if err := validateCondition(until, variables); err != nil {
+			return fmt.Errorf("until: %w", err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,403 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ConditionGroup is a react-querybuilder rule group. Rules are either single conditions or nested groups.
+type ConditionGroup struct {
+	Id         string          `json:"id,omitempty"`
+	Combinator string          `json:"combinator"`
+	Not        bool            `json:"not,omitempty"`
+	Rules      []ConditionRule `json:"rules"`
+}
+
+type ConditionRule struct {
+	Condition *Condition
+	Group     *ConditionGroup
+}
+
+func (r ConditionRule) MarshalJSON() ([]byte, error) {
+	if r.Group != nil {
+		return json.Marshal(r.Group)
+	}
+	return json.Marshal(r.Condition)
+}
+
+func (r *ConditionRule) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Rules json.RawMessage `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	if probe.Rules != nil {
+		r.Group = &ConditionGroup{}
+		return json.Unmarshal(data, r.Group)
+	}
+	r.Condition = &Condition{}
+	return json.Unmarshal(data, r.Condition)
+}
+
+// NewConditionGroup converts the flat Conditions list of old profiles into a group.
+func NewConditionGroup(conditionsCombinator string, conditions []Condition) *ConditionGroup {
+	group := &ConditionGroup{Combinator: ConditionCombinatorAnd}
+	if strings.EqualFold(conditionsCombinator, ConditionCombinatorOr) {
+		group.Combinator = ConditionCombinatorOr
+	}
+	for i := range conditions {
+		group.Rules = append(group.Rules, ConditionRule{Condition: &conditions[i]})
+	}
+	return group
+}
+
+func (g *ConditionGroup) String() string {
+	var pieces []string
+	for _, rule := range g.Rules {
+		if rule.Group != nil {
+			pieces = append(pieces, "("+rule.Group.String()+")")
+		} else if rule.Condition != nil {
+			pieces = append(pieces, rule.Condition.String())
+		}
+	}
+	combinator := ConditionCombinatorAnd
+	if strings.EqualFold(g.Combinator, ConditionCombinatorOr) {
+		combinator = ConditionCombinatorOr
+	}
+	result := strings.Join(pieces, " "+combinator+" ")
+	if g.Not {
+		return "NOT (" + result + ")"
+	}
+	return result
+}
+
+func (c Condition) String() string {
+	result := c.Field + " " + c.Operator + " " + formatConditionValue(c.ValueSource, c.Value)
+	if c.ForMilliseconds > 0 {
+		result += " FOR " + strconv.FormatInt(c.ForMilliseconds, 10)
+	}
+	if c.UntilOperator != "" {
+		until := c.until()
+		result += " UNTIL " + until.Operator + " " + formatConditionValue(until.ValueSource, until.Value)
+	}
+	return result
+}
+
+func formatConditionValue(valueSource string, value string) string {
+	switch normalizeValueSource(valueSource) {
+	case ValueSourceVariable:
+		return "$" + value
+	case ValueSourceRandom:
+		return "random(" + value + ")"
+	case ValueSourceStat:
+		return value
+	}
+	if strings.ContainsAny(value, " ()\"") || value == "" {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
+
+// ParseConditionExpression parses text like "(my_hp < 40 AND my_mp > 20) OR NOT party_member_hp_1 > 30".
+// NOT binds tighter than AND, AND binds tighter than OR. Values are literals, other fields
+// (my_hp < party_member_hp_2), profile variables ($threshold) or random ranges (random(40,60)).
+// A comparison may be suffixed with "FOR <ms>" and "UNTIL [field] <operator> <value>", e.g. "my_mp < 20 UNTIL > 90",
+// the until value has its own value source.
+func ParseConditionExpression(expr string) (*ConditionGroup, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens}
+	if len(tokens) == 0 {
+		return &ConditionGroup{Combinator: ConditionCombinatorAnd}, nil
+	}
+	rule, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].pos)
+	}
+	if rule.Group != nil {
+		return rule.Group, nil
+	}
+	return &ConditionGroup{Combinator: ConditionCombinatorAnd, Rules: []ConditionRule{rule}}, nil
+}
+
+const (
+	tokenIdent = iota
+	tokenOperator
+	tokenString
+	tokenOpen
+	tokenClose
+)
+
+type conditionToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func tokenizeCondition(expr string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, conditionToken{tokenOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, conditionToken{tokenClose, ")", i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, conditionToken{tokenString, string(runes[i+1 : end]), i})
+			i = end + 1
+		case strings.ContainsRune("<>=!&|", c):
+			start := i
+			for i < len(runes) && strings.ContainsRune("<>=!&|", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, conditionToken{tokenOperator, string(runes[start:i]), start})
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_.,-+%$", c):
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_.,-+%$", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, conditionToken{tokenIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek() *conditionToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *conditionParser) keyword(names ...string) bool {
+	token := p.peek()
+	if token == nil || (token.kind != tokenIdent && token.kind != tokenOperator) {
+		return false
+	}
+	for _, name := range names {
+		if strings.EqualFold(token.text, name) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *conditionParser) parseOr() (ConditionRule, error) {
+	return p.parseBinary(ConditionCombinatorOr, []string{"OR", "||"}, p.parseAnd)
+}
+
+func (p *conditionParser) parseAnd() (ConditionRule, error) {
+	return p.parseBinary(ConditionCombinatorAnd, []string{"AND", "&&"}, p.parseUnary)
+}
+
+func (p *conditionParser) parseBinary(combinator string, keywords []string, next func() (ConditionRule, error)) (ConditionRule, error) {
+	first, err := next()
+	if err != nil {
+		return ConditionRule{}, err
+	}
+	rules := []ConditionRule{first}
+	for p.keyword(keywords...) {
+		rule, err := next()
+		if err != nil {
+			return ConditionRule{}, err
+		}
+		// flatten "a AND (b AND c)" into one group
+		if rule.Group != nil && !rule.Group.Not && rule.Group.Combinator == combinator {
+			rules = append(rules, rule.Group.Rules...)
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 1 {
+		return first, nil
+	}
+	if first.Group != nil && !first.Group.Not && first.Group.Combinator == combinator {
+		rules = append(first.Group.Rules, rules[1:]...)
+	}
+	return ConditionRule{Group: &ConditionGroup{Combinator: combinator, Rules: rules}}, nil
+}
+
+func (p *conditionParser) parseUnary() (ConditionRule, error) {
+	if p.keyword("NOT", "!") {
+		rule, err := p.parseUnary()
+		if err != nil {
+			return ConditionRule{}, err
+		}
+		if rule.Group != nil {
+			rule.Group.Not = !rule.Group.Not
+			return rule, nil
+		}
+		return ConditionRule{Group: &ConditionGroup{Combinator: ConditionCombinatorAnd, Not: true, Rules: []ConditionRule{rule}}}, nil
+	}
+	token := p.peek()
+	if token == nil {
+		return ConditionRule{}, errors.New("unexpected end of expression")
+	}
+	if token.kind == tokenOpen {
+		p.pos++
+		rule, err := p.parseOr()
+		if err != nil {
+			return ConditionRule{}, err
+		}
+		if token := p.peek(); token == nil || token.kind != tokenClose {
+			return ConditionRule{}, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return rule, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (ConditionRule, error) {
+	field := p.peek()
+	if field == nil || field.kind != tokenIdent {
+		return ConditionRule{}, p.unexpected("field name")
+	}
+	p.pos++
+	fieldName := field.text
+	if token := p.peek(); token != nil && token.kind == tokenOpen {
+		args, err := p.parseArgs()
+		if err != nil {
+			return ConditionRule{}, err
+		}
+		fieldName += "(" + args + ")"
+	}
+	operator := p.peek()
+	if operator == nil || (operator.kind != tokenOperator && operator.kind != tokenIdent) {
+		return ConditionRule{}, p.unexpected("operator")
+	}
+	p.pos++
+	condition := &Condition{
+		Field:    fieldName,
+		Operator: operator.text,
+	}
+	var err error
+	if condition.ValueSource, condition.Value, err = p.parseValue("value"); err != nil {
+		return ConditionRule{}, err
+	}
+	if err := p.parseModifiers(condition); err != nil {
+		return ConditionRule{}, err
+	}
+	return ConditionRule{Condition: condition}, nil
+}
+
+// parseValue parses the right side of a comparison and tells its value source: a literal,
+// another field, a $variable or a random(low,high) range.
+func (p *conditionParser) parseValue(expected string) (valueSource string, value string, err error) {
+	token := p.peek()
+	if token == nil || (token.kind != tokenIdent && token.kind != tokenString) {
+		return "", "", p.unexpected(expected)
+	}
+	p.pos++
+	if token.kind == tokenString {
+		return "", token.text, nil
+	}
+	switch {
+	case strings.HasPrefix(token.text, "$"):
+		return ValueSourceVariable, strings.TrimPrefix(token.text, "$"), nil
+	case strings.EqualFold(token.text, ValueSourceRandom):
+		bounds, err := p.parseArgs()
+		return ValueSourceRandom, bounds, err
+	case conditionFieldFactories[token.text] != nil:
+		args, err := p.parseArgs()
+		return ValueSourceStat, token.text + "(" + args + ")", err
+	}
+	if _, ok := lookupConditionField(token.text); ok {
+		return ValueSourceStat, token.text, nil
+	}
+	return "", token.text, nil
+}
+
+// parseModifiers parses the optional "FOR 3000" and "UNTIL > 90" suffixes of a comparison.
+func (p *conditionParser) parseModifiers(condition *Condition) error {
+	if p.keyword("FOR") {
+		duration := p.peek()
+		if duration == nil || duration.kind != tokenIdent {
+			return p.unexpected("duration in milliseconds")
+		}
+		ms, err := strconv.ParseInt(duration.text, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q at position %d", duration.text, duration.pos)
+		}
+		p.pos++
+		condition.ForMilliseconds = ms
+	}
+	if p.keyword("UNTIL") {
+		// "UNTIL my_hp > 80" repeats the field of "my_hp < 40 UNTIL > 80"
+		if field := p.peek(); field != nil && field.kind == tokenIdent && field.text == condition.Field {
+			p.pos++
+		}
+		operator := p.peek()
+		if operator == nil || (operator.kind != tokenOperator && operator.kind != tokenIdent) {
+			return p.unexpected("until operator")
+		}
+		p.pos++
+		valueSource, value, err := p.parseValue("until value")
+		if err != nil {
+			return err
+		}
+		condition.UntilOperator = operator.text
+		condition.UntilValueSource = valueSource
+		condition.UntilValue = value
+	}
+	return nil
+}
+
+// parseArgs parses the "(40,60)" part of "random(40,60)" or "party_count_below(hp, 50)".
+func (p *conditionParser) parseArgs() (string, error) {
+	if token := p.peek(); token == nil || token.kind != tokenOpen {
+		return "", p.unexpected("(")
+	}
+	p.pos++
+	var args string
+	for token := p.peek(); token != nil && token.kind == tokenIdent; token = p.peek() {
+		args += token.text
+		p.pos++
+	}
+	if args == "" {
+		return "", p.unexpected("arguments")
+	}
+	if token := p.peek(); token == nil || token.kind != tokenClose {
+		return "", p.unexpected(")")
+	}
+	p.pos++
+	return args, nil
+}
+
+func (p *conditionParser) unexpected(expected string) error {
+	if token := p.peek(); token != nil {
+		return fmt.Errorf("expected %s, got %q at position %d", expected, token.text, token.pos)
+	}
+	return fmt.Errorf("expected %s, got end of expression", expected)
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+)
+
+func TestParseConditionExpression(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"and binds tighter than or", "my_hp < 40 AND my_mp > 20 OR target_hp = 0", "(my_hp < 40 AND my_mp > 20) OR target_hp = 0"},
+		{"and binds tighter than or on the right", "my_hp < 40 OR my_mp > 20 AND target_hp = 0", "my_hp < 40 OR (my_mp > 20 AND target_hp = 0)"},
+		{"symbol combinators", "my_hp < 40 && my_mp > 20 || target_hp = 0", "(my_hp < 40 AND my_mp > 20) OR target_hp = 0"},
+		{"chained and is flattened", "my_hp < 40 AND (my_mp > 20 AND target_hp = 0)", "my_hp < 40 AND my_mp > 20 AND target_hp = 0"},
+		{"not binds tighter than and", "NOT my_hp < 40 AND my_mp > 20", "(NOT (my_hp < 40)) AND my_mp > 20"},
+		{"not of a group", "NOT (my_hp < 40 OR my_mp > 20)", "NOT (my_hp < 40 OR my_mp > 20)"},
+		{"bang not", "!my_hp < 40", "NOT (my_hp < 40)"},
+		{"double not", "NOT NOT (my_hp < 40 OR my_mp > 20)", "my_hp < 40 OR my_mp > 20"},
+		{"parentheses with spaces", "( my_hp < 40 )  AND (  my_mp > 20 ) ", "my_hp < 40 AND my_mp > 20"},
+		{"nested parentheses", "((my_hp < 40))", "my_hp < 40"},
+		{"parentheses override precedence", "my_hp < 40 AND (my_mp > 20 OR target_hp = 0)", "my_hp < 40 AND (my_mp > 20 OR target_hp = 0)"},
+		{"range operator", "my_hp between 20,60", "my_hp between 20,60"},
+		{"stat value", "my_hp < party_member_hp_2", "my_hp < party_member_hp_2"},
+		{"variable value", "my_hp < $low", "my_hp < $low"},
+		{"random value", "my_hp < random(40,60)", "my_hp < random(40,60)"},
+		{"parameterized field", "party_count_below(hp, 50) >= 2", "party_count_below(hp,50) >= 2"},
+		{"modifiers", "my_mp < 20 FOR 3000 UNTIL > 90", "my_mp < 20 FOR 3000 UNTIL > 90"},
+		{"until repeating the field", "my_hp < 40 UNTIL my_hp > 80", "my_hp < 40 UNTIL > 80"},
+		{"until literal after a variable", "my_hp < $low UNTIL my_hp > 80", "my_hp < $low UNTIL > 80"},
+		{"until variable after a literal", "my_hp < 40 UNTIL > $high", "my_hp < 40 UNTIL > $high"},
+		{"until stat", "my_hp < 40 UNTIL >= party_min_hp", "my_hp < 40 UNTIL >= party_min_hp"},
+		{"until random", "my_hp < 40 UNTIL > random(70,90)", "my_hp < 40 UNTIL > random(70,90)"},
+		{"empty", "  ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, err := ParseConditionExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseConditionExpression(%q) error: %v", tt.expr, err)
+			}
+			if got := group.String(); got != tt.want {
+				t.Errorf("ParseConditionExpression(%q) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConditionExpressionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"missing value", "my_hp <", "expected value"},
+		{"missing operator", "my_hp", "expected operator"},
+		{"missing closing parenthesis", "(my_hp < 40", "missing closing parenthesis"},
+		{"extra closing parenthesis", "my_hp < 40)", "unexpected \")\""},
+		{"dangling and", "my_hp < 40 AND", "unexpected end of expression"},
+		{"dangling not", "NOT", "unexpected end of expression"},
+		{"unterminated string", "my_hp < \"40", "unterminated string"},
+		{"unexpected character", "my_hp # 40", "unexpected '#'"},
+		{"invalid duration", "my_hp < 40 FOR soon", "invalid duration"},
+		{"missing until value", "my_hp < 40 UNTIL >", "expected until value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConditionExpression(tt.expr)
+			if err == nil {
+				t.Fatalf("ParseConditionExpression(%q) expected an error", tt.expr)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseConditionExpression(%q) error = %q, want it to contain %q", tt.expr, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateConditionGroup(t *testing.T) {
+	variables := map[string]float64{"low": 30}
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"valid", "my_hp < 40 AND party_count_below(hp,50) >= 2", ""},
+		{"unknown field", "my_hpp < 30", "unknown field \"my_hpp\""},
+		{"unknown nested field", "my_hp < 40 AND (my_mp > 20 OR target_hpp = 0)", "unknown field \"target_hpp\""},
+		{"party mp isn't reported", "party_member_mp_1 < 30", "unknown field \"party_member_mp_1\""},
+		{"party cp isn't reported", "party_count_below(cp,50) > 1", "unknown field"},
+		{"unknown operator", "my_hp above 40", "unsupported operator"},
+		{"unknown value field", "my_hp < my_cp", "invalid value"},
+		{"unknown variable", "my_hp < $high", "unknown variable \"high\""},
+		{"range expects two values", "my_hp between 40", "expects 2 values"},
+		{"valid until variable", "my_hp < 40 UNTIL > $low", ""},
+		{"unknown until variable", "my_hp < $low UNTIL > $high", "until: unknown variable \"high\""},
+		{"invalid until literal", "my_hp < $low UNTIL > high", "until: invalid value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, err := ParseConditionExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseConditionExpression(%q) error: %v", tt.expr, err)
+			}
+			err = ValidateConditionGroup(group, variables)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("ValidateConditionGroup(%q) error: %v", tt.expr, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ValidateConditionGroup(%q) error = %v, want it to contain %q", tt.expr, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareConditionsExpressionAndQuery(t *testing.T) {
+	same, _ := ParseConditionExpression("my_hp < 40")
+	other, _ := ParseConditionExpression("my_mp < 40")
+	tests := []struct {
+		name    string
+		query   *ConditionGroup
+		wantErr bool
+	}{
+		{"no query", nil, false},
+		{"empty query builder", &ConditionGroup{Combinator: ConditionCombinatorAnd}, false},
+		{"same query", same, false},
+		{"different query", other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := &ProfileTemplate{Items: []ProfileTemplateItem{{Expression: "my_hp < 40", Query: tt.query}}}
+			err := prepareConditions(template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareConditions error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && template.Items[0].Query.String() != "my_hp < 40" {
+				t.Errorf("query = %q, want the expression", template.Items[0].Query.String())
+			}
+		})
+	}
+}
+
+func TestParseConditionExpressionUntilSource(t *testing.T) {
+	tests := []struct {
+		expr       string
+		wantSource string
+		wantValue  string
+	}{
+		{"my_hp < $low UNTIL my_hp > 80", "", "80"},
+		{"my_hp < 40 UNTIL > $high", ValueSourceVariable, "high"},
+		{"my_hp < 40 UNTIL > party_min_hp", ValueSourceStat, "party_min_hp"},
+		{"my_hp < 40 UNTIL > random(70,90)", ValueSourceRandom, "70,90"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			group, err := ParseConditionExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseConditionExpression(%q) error: %v", tt.expr, err)
+			}
+			condition := group.Rules[0].Condition
+			if condition.UntilValueSource != tt.wantSource || condition.UntilValue != tt.wantValue {
+				t.Errorf("until = %q %q, want %q %q", condition.UntilValueSource, condition.UntilValue, tt.wantSource, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestConditionUntilReleasesWithOwnValueSource(t *testing.T) {
+	tests := []struct {
+		expr string
+		hp   []float64
+		want []bool
+	}{
+		{"my_hp < $low UNTIL my_hp > 80", []float64{20, 50, 85, 50}, []bool{true, true, false, false}},
+		{"my_hp < 30 UNTIL > $high", []float64{20, 50, 85, 50}, []bool{true, true, false, false}},
+	}
+	variables := map[string]float64{"low": 30, "high": 80}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			group, err := ParseConditionExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseConditionExpression(%q) error: %v", tt.expr, err)
+			}
+			if err := ValidateConditionGroup(group, variables); err != nil {
+				t.Fatalf("ValidateConditionGroup(%q) error: %v", tt.expr, err)
+			}
+			state := NewConditionState()
+			for i, hp := range tt.hp {
+				stat := &entity.PlayerStat{}
+				stat.HP.Percent = hp
+				got, err := CheckConditionGroup(group, ConditionEnv{Stat: stat, Variables: variables, Now: time.Now(), State: state}, nil)
+				if err != nil {
+					t.Fatalf("CheckConditionGroup error: %v", err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("hp %v: got %v, want %v", hp, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
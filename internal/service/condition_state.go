@@ -0,0 +1,67 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// ConditionState tracks the ForMilliseconds and Until modifiers of one profile item between ticks.
+type ConditionState struct {
+	mu     sync.Mutex
+	tracks map[string]*conditionTrack
+}
+
+type conditionTrack struct {
+	trueSince time.Time
+	latched   bool
+}
+
+func NewConditionState() *ConditionState {
+	return &ConditionState{tracks: make(map[string]*conditionTrack)}
+}
+
+// apply turns the raw comparison result into the modified one. The condition is identified
+// by its position in the group, as ids are optional.
+func (s *ConditionState) apply(condition Condition, path string, result bool, env ConditionEnv) bool {
+	if condition.ForMilliseconds <= 0 && condition.UntilOperator == "" {
+		return result
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	track, ok := s.tracks[path]
+	if !ok {
+		track = &conditionTrack{}
+		s.tracks[path] = track
+	}
+	if condition.ForMilliseconds > 0 {
+		if !result {
+			track.trueSince = time.Time{}
+		} else {
+			if track.trueSince.IsZero() {
+				track.trueSince = env.Now
+			}
+			result = env.Now.Sub(track.trueSince) >= time.Duration(condition.ForMilliseconds)*time.Millisecond
+		}
+	}
+	if condition.UntilOperator != "" {
+		if track.latched {
+			if recovered, _ := compareCondition(condition.until(), env); recovered {
+				track.latched = false
+				return false
+			}
+			return true
+		}
+		track.latched = result
+	}
+	return result
+}
+
+// until is the comparison that releases a latched condition.
+func (c Condition) until() Condition {
+	return Condition{
+		Field:       c.Field,
+		Operator:    c.UntilOperator,
+		ValueSource: c.UntilValueSource,
+		Value:       c.UntilValue,
+	}
+}
@@ -1,40 +1,213 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"sync"
+	"time"
 
 	"github.com/gibgibik/go-ch9329/pkg/ch9329"
 	"github.com/gibgibik/go-lineage2-macros/internal/core"
 	"go.bug.st/serial"
+	"go.uber.org/zap"
 )
 
+const (
+	ControlDriverCh9329    = "ch9329"
+	ControlDriverRecording = "recording"
+
+	// CH9329 serial protocol: frame header, address and the commands sent without the client
+	ch9329FrameHead1        byte = 0x57
+	ch9329FrameHead2        byte = 0xab
+	ch9329Address           byte = 0x00
+	ch9329CmdKeyboard       byte = 0x02
+	ch9329CmdMouseRelative  byte = 0x05
+	ch9329MouseRelativeMode byte = 0x01
+)
+
+// Controller sends keyboard and mouse input to the game.
+type Controller interface {
+	SendKey(modifier byte, key string) (n int, err error)
+	// SendKeys presses up to 6 keys at once, they're sent in a single keyboard report
+	SendKeys(modifier byte, keys []string) (n int, err error)
+	EndKey() (n int, err error)
+	MouseActionAbsolute(pressButton byte, point image.Point, wheel byte) (n int, err error)
+	MouseAbsoluteEnd() (n int, err error)
+	// MouseActionRelative moves the cursor by delta, within -127..127, with pressButton held
+	MouseActionRelative(pressButton byte, delta image.Point, wheel byte) (n int, err error)
+}
+
+const (
+	DeviceDisconnected = "disconnected"
+	DeviceConnected    = "connected"
+	DeviceReconnecting = "reconnecting"
+	DeviceFailed       = "failed"
+
+	controlReconnectMinBackoff = time.Millisecond * 500
+	controlReconnectMaxBackoff = time.Second * 30
+	// after that many failed attempts the device is reported as failed, reconnecting goes on
+	controlReconnectAttempts = 10
+)
+
+var ErrDeviceDown = errors.New("control device is down")
+
+// DeviceStatus describes the health of the input device.
+type DeviceStatus struct {
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// StatusReporter is implemented by the controllers which may go down while running.
+type StatusReporter interface {
+	Status() DeviceStatus
+}
+
+// Control drives the CH9329 USB HID adapter over the serial port. A failed write closes the port
+// and reopens it in the background with backoff, ErrDeviceDown is returned in the meantime.
 type Control struct {
 	sync.Mutex
-	cl *ch9329.Client
+	cl     *ch9329.Client
+	port   serial.Port
+	cnf    core.Control
+	logger *zap.SugaredLogger
+
+	statusMutex sync.Mutex
+	status      DeviceStatus
 }
 
 func (c *Control) SendKey(modifier byte, key string) (n int, err error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
-	return c.cl.SendKey(modifier, key)
+	if c.cl == nil {
+		return 0, ErrDeviceDown
+	}
+	n, err = c.cl.SendKey(modifier, key)
+	c.checkWrite(err)
+	return n, err
+}
+
+func (c *Control) SendKeys(modifier byte, keys []string) (n int, err error) {
+	if len(keys) == 1 && !hidKey(keys[0]) {
+		return c.SendKey(modifier, keys[0])
+	}
+	modifier, codes, err := KeyboardReport(modifier, keys)
+	if err != nil {
+		return 0, err
+	}
+	return c.writeFrame(ch9329CmdKeyboard, append([]byte{modifier, 0x00}, codes[:]...))
 }
 
 func (c *Control) MouseActionAbsolute(pressButton byte, point image.Point, wheel byte) (n int, err error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
-	return c.cl.MouseActionAbsolute(pressButton, point, wheel)
+	if c.cl == nil {
+		return 0, ErrDeviceDown
+	}
+	n, err = c.cl.MouseActionAbsolute(pressButton, point, wheel)
+	c.checkWrite(err)
+	return n, err
+}
+
+func (c *Control) MouseActionRelative(pressButton byte, delta image.Point, wheel byte) (n int, err error) {
+	if abs(delta.X) > mouseRelativeMax || abs(delta.Y) > mouseRelativeMax {
+		return 0, fmt.Errorf("relative move %s is out of -%d..%d", delta, mouseRelativeMax, mouseRelativeMax)
+	}
+	return c.writeFrame(ch9329CmdMouseRelative, []byte{ch9329MouseRelativeMode, pressButton, byte(int8(delta.X)), byte(int8(delta.Y)), wheel})
 }
 
 func (c *Control) MouseAbsoluteEnd() (n int, err error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
-	return c.cl.MouseAbsoluteEnd()
+	if c.cl == nil {
+		return 0, ErrDeviceDown
+	}
+	n, err = c.cl.MouseAbsoluteEnd()
+	c.checkWrite(err)
+	return n, err
 }
 func (c *Control) EndKey() (n int, err error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
-	return c.cl.EndKey()
+	if c.cl == nil {
+		return 0, ErrDeviceDown
+	}
+	n, err = c.cl.EndKey()
+	c.checkWrite(err)
+	return n, err
+}
+
+// writeFrame sends a CH9329 command the client has no method for.
+func (c *Control) writeFrame(cmd byte, data []byte) (n int, err error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if c.cl == nil {
+		return 0, ErrDeviceDown
+	}
+	n, err = c.port.Write(ch9329Frame(cmd, data))
+	c.checkWrite(err)
+	return n, err
+}
+
+func (c *Control) Status() DeviceStatus {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	return c.status
+}
+
+func (c *Control) setStatus(state string, attempts int, err error) {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	if c.status.State != state {
+		c.status.Since = time.Now()
+	}
+	c.status.State = state
+	c.status.Attempts = attempts
+	c.status.Error = ""
+	if err != nil {
+		c.status.Error = err.Error()
+	}
+}
+
+// checkWrite must be called with the mutex held.
+func (c *Control) checkWrite(err error) {
+	if err == nil {
+		return
+	}
+	c.logger.Errorf("control device write error, reconnecting: %v", err)
+	_ = c.port.Close()
+	c.cl = nil
+	c.port = nil
+	c.setStatus(DeviceReconnecting, 0, err)
+	go c.reconnect()
+}
+
+func (c *Control) reconnect() {
+	backoff := controlReconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		time.Sleep(backoff)
+		port, err := openSerialPort(c.cnf)
+		if err == nil {
+			c.Mutex.Lock()
+			c.port = port
+			c.cl = newCh9329Client(port, c.cnf)
+			c.Mutex.Unlock()
+			c.setStatus(DeviceConnected, 0, nil)
+			c.logger.Infof("control device reconnected after %d attempts", attempt)
+			return
+		}
+		if attempt == controlReconnectAttempts {
+			c.logger.Errorf("control device failed, still retrying every %s: %v", controlReconnectMaxBackoff, err)
+		}
+		if attempt >= controlReconnectAttempts {
+			c.setStatus(DeviceFailed, attempt, err)
+		} else {
+			c.setStatus(DeviceReconnecting, attempt, err)
+		}
+		backoff = min(backoff*2, controlReconnectMaxBackoff)
+	}
 }
 
 var (
@@ -49,22 +222,101 @@ var (
 		"8": {40, 525},
 	}
 
-	control *Control
+	// opened devices by name, see core.Config.Devices
+	controls      = make(map[string]Controller)
+	controlsMutex sync.Mutex
 )
 
-func GetControl(cnf core.Control) (*Control, error) {
-	if control != nil {
+// GetControl opens the default device once and returns it on subsequent calls, see GetDeviceControl.
+func GetControl(cnf core.Control, logger *zap.SugaredLogger) (Controller, error) {
+	return GetDeviceControl(core.DefaultDevice, cnf, logger)
+}
+
+// GetDeviceControl opens the named device, selected by its driver setting, once and returns it
+// on subsequent calls. The device is wrapped in a Recorder, see GetRecorder.
+func GetDeviceControl(name string, cnf core.Control, logger *zap.SugaredLogger) (Controller, error) {
+	controlsMutex.Lock()
+	defer controlsMutex.Unlock()
+	if control, ok := controls[name]; ok {
 		return control, nil
 	}
-	mode := &serial.Mode{
-		BaudRate: cnf.BaudRate,
+	logger = logger.With("device", name)
+	var control Controller
+	switch cnf.Driver {
+	case "", ControlDriverCh9329:
+		cl, err := newCh9329Control(cnf, logger)
+		if err != nil {
+			return nil, err
+		}
+		control = NewRecorder(cl)
+	case ControlDriverRecording:
+		cl, err := NewRecordingControl(cnf.TraceFile)
+		if err != nil {
+			return nil, err
+		}
+		control = NewRecorder(cl)
+	default:
+		return nil, fmt.Errorf("unknown control driver: %s", cnf.Driver)
 	}
-	port, err := serial.Open(cnf.Port, mode)
+	controls[name] = control
+	return control, nil
+}
+
+// GetRecorder returns the recorder of the named device, nil if it wasn't opened yet.
+func GetRecorder(name string) *Recorder {
+	controlsMutex.Lock()
+	defer controlsMutex.Unlock()
+	recorder, _ := controls[name].(*Recorder)
+	return recorder
+}
+
+// GetControlStatuses reports the status of every device opened by GetDeviceControl.
+func GetControlStatuses() map[string]DeviceStatus {
+	controlsMutex.Lock()
+	defer controlsMutex.Unlock()
+	result := make(map[string]DeviceStatus, len(controls))
+	for name, control := range controls {
+		result[name] = DeviceStatus{State: DeviceConnected}
+		if reporter, ok := control.(StatusReporter); ok {
+			result[name] = reporter.Status()
+		}
+	}
+	return result
+}
+
+func newCh9329Control(cnf core.Control, logger *zap.SugaredLogger) (*Control, error) {
+	port, err := openSerialPort(cnf)
 	if err != nil {
 		return nil, err
 	}
-	control = &Control{
-		cl: ch9329.NewClient(port, image.Rect(0, 0, cnf.Resolution[0], cnf.Resolution[1])),
+	c := &Control{
+		cl:     newCh9329Client(port, cnf),
+		port:   port,
+		cnf:    cnf,
+		logger: logger,
 	}
-	return control, nil
+	c.setStatus(DeviceConnected, 0, nil)
+	return c, nil
+}
+
+func openSerialPort(cnf core.Control) (serial.Port, error) {
+	mode := &serial.Mode{
+		BaudRate: cnf.BaudRate,
+	}
+	return serial.Open(cnf.Port, mode)
+}
+
+// ch9329Frame wraps the command data: head, address, command, length, data and the checksum,
+// the low byte of the sum of all the previous bytes.
+func ch9329Frame(cmd byte, data []byte) []byte {
+	frame := append([]byte{ch9329FrameHead1, ch9329FrameHead2, ch9329Address, cmd, byte(len(data))}, data...)
+	var sum byte
+	for _, b := range frame {
+		sum += b
+	}
+	return append(frame, sum)
+}
+
+func newCh9329Client(port serial.Port, cnf core.Control) *ch9329.Client {
+	return ch9329.NewClient(port, image.Rect(0, 0, cnf.Resolution[0], cnf.Resolution[1]))
 }
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+)
+
+// keyboardReportKeys is the number of keys a CH9329 keyboard report holds at once.
+const keyboardReportKeys = 6
+
+var (
+	// hidKeys are the key names with their USB HID keyboard usage IDs, which the CH9329 keyboard
+	// report carries. The aliases are the KeyboardEvent.key names the web UI records.
+	hidKeys = map[string]byte{
+		"enter": 0x28, "esc": 0x29, "backspace": 0x2a, "tab": 0x2b, "space": 0x2c, " ": 0x2c,
+		"return": 0x28, "escape": 0x29, "spacebar": 0x2c,
+		"-": 0x2d, "=": 0x2e, "[": 0x2f, "]": 0x30, "\\": 0x31, ";": 0x33, "'": 0x34, "`": 0x35,
+		",": 0x36, ".": 0x37, "/": 0x38, "capslock": 0x39,
+		"printscreen": 0x46, "scrolllock": 0x47, "pause": 0x48, "insert": 0x49, "home": 0x4a,
+		"pageup": 0x4b, "delete": 0x4c, "end": 0x4d, "pagedown": 0x4e,
+		"ins": 0x49, "pgup": 0x4b, "del": 0x4c, "pgdn": 0x4e,
+		"right": 0x4f, "left": 0x50, "down": 0x51, "up": 0x52,
+		"arrowright": 0x4f, "arrowleft": 0x50, "arrowdown": 0x51, "arrowup": 0x52,
+		"numlock": 0x53, "contextmenu": 0x65,
+	}
+	// hidShiftedKeys are typed with shift held on a US layout, the web UI records them as such
+	hidShiftedKeys = map[string]byte{
+		"!": 0x1e, "@": 0x1f, "#": 0x20, "$": 0x21, "%": 0x22, "^": 0x23, "&": 0x24, "*": 0x25,
+		"(": 0x26, ")": 0x27, "_": 0x2d, "+": 0x2e, "{": 0x2f, "}": 0x30, "|": 0x31, ":": 0x33,
+		"\"": 0x34, "~": 0x35, "<": 0x36, ">": 0x37, "?": 0x38,
+	}
+)
+
+func init() {
+	for i := byte(0); i < 26; i++ {
+		hidKeys[string(rune('a'+i))] = 0x04 + i
+	}
+	for i := byte(1); i <= 9; i++ {
+		hidKeys[string(rune('0'+i))] = 0x1d + i
+	}
+	hidKeys["0"] = 0x27
+	for i := byte(1); i <= 12; i++ {
+		hidKeys[fmt.Sprintf("f%d", i)] = 0x39 + i
+	}
+	for i := byte(13); i <= 24; i++ {
+		hidKeys[fmt.Sprintf("f%d", i)] = 0x5b + i
+	}
+}
+
+// KeyboardReport converts the keys pressed at once into the modifier byte and the usage IDs
+// of a single keyboard report, the shifted characters add the left shift.
+func KeyboardReport(modifier byte, keys []string) (byte, [keyboardReportKeys]byte, error) {
+	var codes [keyboardReportKeys]byte
+	if len(keys) > keyboardReportKeys {
+		return 0, codes, fmt.Errorf("at most %d keys can be pressed at once, got %d", keyboardReportKeys, len(keys))
+	}
+	for i, key := range keys {
+		if code, ok := hidKeys[key]; ok {
+			codes[i] = code
+			continue
+		}
+		code, ok := hidShiftedKeys[key]
+		if !ok {
+			return 0, codes, fmt.Errorf("unknown key %q", key)
+		}
+		codes[i] = code
+		modifier |= ch9329.ModLeftShift
+	}
+	return modifier, codes, nil
+}
+
+// hidKey reports whether the key is in the keyboard report tables, the other names are sent
+// through the CH9329 library mapping and can't be pressed together with other keys.
+func hidKey(key string) bool {
+	_, ok := hidKeys[key]
+	if !ok {
+		_, ok = hidShiftedKeys[key]
+	}
+	return ok
+}
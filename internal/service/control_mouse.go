@@ -0,0 +1,206 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/gibgibik/go-ch9329/pkg/ch9329"
+)
+
+const (
+	MouseButtonLeft   = "left"
+	MouseButtonRight  = "right"
+	MouseButtonMiddle = "middle"
+
+	// mouseDragStepPx is the distance between the intermediate points of a drag or a relative move
+	mouseDragStepPx = 20
+	// mouseRelativeMax bounds dx and dy of a CH9329 relative mouse report, they're signed bytes
+	mouseRelativeMax = 127
+)
+
+var mouseButtons = map[string]byte{
+	MouseButtonLeft:   ch9329.MousePressLeft,
+	MouseButtonRight:  ch9329.MousePressRight,
+	MouseButtonMiddle: ch9329.MousePressMiddle,
+}
+
+// MouseDrag presses Button at From, moves the cursor to To and releases it there.
+type MouseDrag struct {
+	Button byte
+	From   image.Point
+	To     image.Point
+}
+
+// MouseScroll turns the wheel by Notches at Point, positive notches scroll up.
+type MouseScroll struct {
+	Notches int
+	Point   image.Point
+}
+
+// ScreenRect converts the control.resolution setting, an empty rectangle disables the coordinate checks.
+func ScreenRect(resolution []int) image.Rectangle {
+	if len(resolution) != 2 {
+		return image.Rectangle{}
+	}
+	return image.Rect(0, 0, resolution[0], resolution[1])
+}
+
+// ParseDragArgs reads the Additional of /drag: "x1,y1,x2,y2" with an optional button, left by default.
+func ParseDragArgs(additional string, screen image.Rectangle) (MouseDrag, error) {
+	var drag MouseDrag
+	args := splitMouseArgs(additional)
+	if len(args) != 4 && len(args) != 5 {
+		return drag, errors.New("drag expects x1,y1,x2,y2[,button]")
+	}
+	points, err := parseMouseInts(args[:4])
+	if err != nil {
+		return drag, err
+	}
+	drag.Button = ch9329.MousePressLeft
+	if len(args) == 5 {
+		button, ok := mouseButtons[args[4]]
+		if !ok {
+			return drag, fmt.Errorf("unknown mouse button %q", args[4])
+		}
+		drag.Button = button
+	}
+	drag.From = image.Point{X: points[0], Y: points[1]}
+	drag.To = image.Point{X: points[2], Y: points[3]}
+	if err := checkScreenPoint(drag.From, screen); err != nil {
+		return drag, err
+	}
+	return drag, checkScreenPoint(drag.To, screen)
+}
+
+// ParseScrollArgs reads the Additional of /scroll: "notches" or "notches,x,y", at the screen center by default.
+func ParseScrollArgs(additional string, screen image.Rectangle) (MouseScroll, error) {
+	var scroll MouseScroll
+	args := splitMouseArgs(additional)
+	if len(args) != 1 && len(args) != 3 {
+		return scroll, errors.New("scroll expects notches[,x,y]")
+	}
+	values, err := parseMouseInts(args)
+	if err != nil {
+		return scroll, err
+	}
+	if values[0] == 0 || values[0] < -127 || values[0] > 127 {
+		return scroll, fmt.Errorf("scroll notches must be within -127..127 and not 0, got %d", values[0])
+	}
+	scroll.Notches = values[0]
+	scroll.Point = screenCenter(screen)
+	if len(values) == 3 {
+		scroll.Point = image.Point{X: values[1], Y: values[2]}
+	}
+	return scroll, checkScreenPoint(scroll.Point, screen)
+}
+
+// ParseRotateCameraArgs reads the Additional of /rotatecamera: "dx,dy", the distance the cursor
+// is moved by with the right button held, wherever it is.
+func ParseRotateCameraArgs(additional string) (image.Point, error) {
+	args := splitMouseArgs(additional)
+	if len(args) != 2 {
+		return image.Point{}, errors.New("rotatecamera expects dx,dy")
+	}
+	values, err := parseMouseInts(args)
+	if err != nil {
+		return image.Point{}, err
+	}
+	if values[0] == 0 && values[1] == 0 {
+		return image.Point{}, errors.New("rotatecamera expects a non zero dx,dy")
+	}
+	return image.Point{X: values[0], Y: values[1]}, nil
+}
+
+// DragPath returns the points between from and to, to included, spaced by about mouseDragStepPx.
+func DragPath(from, to image.Point) []image.Point {
+	delta := to.Sub(from)
+	steps := max(abs(delta.X), abs(delta.Y)) / mouseDragStepPx
+	if steps < 1 {
+		steps = 1
+	}
+	path := make([]image.Point, 0, steps)
+	for i := 1; i <= steps; i++ {
+		path = append(path, image.Point{
+			X: from.X + delta.X*i/steps,
+			Y: from.Y + delta.Y*i/steps,
+		})
+	}
+	return path
+}
+
+// RelativeSteps splits a relative move into steps of about mouseDragStepPx, each one fits a relative mouse report.
+func RelativeSteps(delta image.Point) []image.Point {
+	var previous image.Point
+	path := DragPath(image.Point{}, delta)
+	steps := make([]image.Point, 0, len(path))
+	for _, point := range path {
+		steps = append(steps, point.Sub(previous))
+		previous = point
+	}
+	return steps
+}
+
+// WheelByte encodes the notches the way CH9329 expects them: 0x01-0x7F up, 0x81-0xFF down.
+func WheelByte(notches int) byte {
+	return byte(int8(notches))
+}
+
+// validateMouseItem checks the arguments of the mouse actions when the profile is saved.
+func validateMouseItem(item ProfileTemplateItem, screen image.Rectangle) error {
+	var err error
+	switch item.Action {
+	case ActionDrag:
+		_, err = ParseDragArgs(item.Additional, screen)
+	case ActionScroll:
+		_, err = ParseScrollArgs(item.Additional, screen)
+	case ActionRotateCamera:
+		_, err = ParseRotateCameraArgs(item.Additional)
+	}
+	return err
+}
+
+func splitMouseArgs(additional string) []string {
+	var args []string
+	for _, arg := range strings.Split(additional, ",") {
+		if arg = strings.ToLower(strings.TrimSpace(arg)); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+func parseMouseInts(args []string) ([]int, error) {
+	values := make([]int, len(args))
+	for i, arg := range args {
+		val, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", arg)
+		}
+		values[i] = val
+	}
+	return values, nil
+}
+
+func checkScreenPoint(point image.Point, screen image.Rectangle) error {
+	if screen.Empty() || point.In(screen) {
+		return nil
+	}
+	return fmt.Errorf("point %s is outside of the screen %s", point, screen)
+}
+
+func screenCenter(screen image.Rectangle) image.Point {
+	if screen.Empty() {
+		return image.Point{X: 960, Y: 540}
+	}
+	return image.Point{X: screen.Min.X + screen.Dx()/2, Y: screen.Min.Y + screen.Dy()/2}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseRotateCameraArgs(t *testing.T) {
+	delta, err := ParseRotateCameraArgs(" -300, 40 ")
+	if err != nil || delta != image.Pt(-300, 40) {
+		t.Errorf("ParseRotateCameraArgs = %v, %v, want (-300,40)", delta, err)
+	}
+	for _, additional := range []string{"", "10", "0,0", "a,b", "1,2,3"} {
+		if _, err := ParseRotateCameraArgs(additional); err == nil {
+			t.Errorf("ParseRotateCameraArgs(%q) expected an error", additional)
+		}
+	}
+}
+
+func TestRelativeSteps(t *testing.T) {
+	for _, delta := range []image.Point{{300, -45}, {-1000, 0}, {5, 5}, {0, -127}} {
+		var sum image.Point
+		for _, step := range RelativeSteps(delta) {
+			if abs(step.X) > mouseRelativeMax || abs(step.Y) > mouseRelativeMax {
+				t.Errorf("RelativeSteps(%v) step %v doesn't fit a report", delta, step)
+			}
+			sum = sum.Add(step)
+		}
+		if sum != delta {
+			t.Errorf("RelativeSteps(%v) moves by %v", delta, sum)
+		}
+	}
+}
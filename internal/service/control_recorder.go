@@ -0,0 +1,211 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const recordingsDir = "var/recordings" //@todo move to config
+
+var (
+	ErrRecordingStarted    = errors.New("recording already started")
+	ErrRecordingNotStarted = errors.New("recording not started")
+)
+
+// Recorder passes the input to the wrapped Controller and, while recording, also writes it
+// to a file which the /replay action plays back.
+type Recorder struct {
+	Controller
+	mutex sync.Mutex
+	trace *RecordingControl
+	file  *os.File
+	name  string
+}
+
+func NewRecorder(c Controller) *Recorder {
+	return &Recorder{Controller: c}
+}
+
+// Start records the input into var/recordings/<name>.json, replacing a previous recording.
+func (r *Recorder) Start(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file != nil {
+		return ErrRecordingStarted
+	}
+	fileName, err := getRecordingPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	fh, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	r.file = fh
+	r.name = name
+	r.trace = NewRecordingControlWriter(fh)
+	return nil
+}
+
+// Stop closes the recording and returns its name.
+func (r *Recorder) Stop() (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return "", ErrRecordingNotStarted
+	}
+	err := r.file.Close()
+	name := r.name
+	r.file, r.trace, r.name = nil, nil, ""
+	return name, err
+}
+
+func (r *Recorder) Recording() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file != nil
+}
+
+func (r *Recorder) SendKey(modifier byte, key string) (n int, err error) {
+	if n, err = r.Controller.SendKey(modifier, key); err == nil {
+		r.record(func(trace *RecordingControl) {
+			_, _ = trace.SendKey(modifier, key)
+		})
+	}
+	return n, err
+}
+
+func (r *Recorder) SendKeys(modifier byte, keys []string) (n int, err error) {
+	if n, err = r.Controller.SendKeys(modifier, keys); err == nil {
+		r.record(func(trace *RecordingControl) {
+			_, _ = trace.SendKeys(modifier, keys)
+		})
+	}
+	return n, err
+}
+
+func (r *Recorder) EndKey() (n int, err error) {
+	if n, err = r.Controller.EndKey(); err == nil {
+		r.record(func(trace *RecordingControl) {
+			_, _ = trace.EndKey()
+		})
+	}
+	return n, err
+}
+
+func (r *Recorder) MouseActionAbsolute(pressButton byte, point image.Point, wheel byte) (n int, err error) {
+	if n, err = r.Controller.MouseActionAbsolute(pressButton, point, wheel); err == nil {
+		r.record(func(trace *RecordingControl) {
+			_, _ = trace.MouseActionAbsolute(pressButton, point, wheel)
+		})
+	}
+	return n, err
+}
+
+func (r *Recorder) MouseAbsoluteEnd() (n int, err error) {
+	if n, err = r.Controller.MouseAbsoluteEnd(); err == nil {
+		r.record(func(trace *RecordingControl) {
+			_, _ = trace.MouseAbsoluteEnd()
+		})
+	}
+	return n, err
+}
+
+func (r *Recorder) MouseActionRelative(pressButton byte, delta image.Point, wheel byte) (n int, err error) {
+	if n, err = r.Controller.MouseActionRelative(pressButton, delta, wheel); err == nil {
+		r.record(func(trace *RecordingControl) {
+			_, _ = trace.MouseActionRelative(pressButton, delta, wheel)
+		})
+	}
+	return n, err
+}
+
+// Status reports the status of the wrapped device.
+func (r *Recorder) Status() DeviceStatus {
+	if reporter, ok := r.Controller.(StatusReporter); ok {
+		return reporter.Status()
+	}
+	return DeviceStatus{State: DeviceConnected}
+}
+
+func (r *Recorder) record(write func(trace *RecordingControl)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.trace != nil {
+		write(r.trace)
+	}
+}
+
+// LoadRecording reads the events written by Recorder, the name may have the .json extension.
+func LoadRecording(name string) ([]InputEvent, error) {
+	fileName, err := getRecordingPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var events []InputEvent
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event InputEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", fileName, line, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// ReplayEvent sends a recorded event through the controller.
+func ReplayEvent(c Controller, event InputEvent) error {
+	var err error
+	switch event.Event {
+	case InputEventSendKey:
+		_, err = c.SendKey(event.Modifier, event.Key)
+	case InputEventSendKeys:
+		_, err = c.SendKeys(event.Modifier, event.Keys)
+	case InputEventEndKey:
+		_, err = c.EndKey()
+	case InputEventMouseAbsolute:
+		if event.Point == nil {
+			return errors.New("mouse event without point")
+		}
+		_, err = c.MouseActionAbsolute(event.Button, *event.Point, event.Wheel)
+	case InputEventMouseRelative:
+		if event.Delta == nil {
+			return errors.New("relative mouse event without delta")
+		}
+		_, err = c.MouseActionRelative(event.Button, *event.Delta, event.Wheel)
+	case InputEventMouseEnd:
+		_, err = c.MouseAbsoluteEnd()
+	default:
+		return fmt.Errorf("unknown input event: %s", event.Event)
+	}
+	return err
+}
+
+func getRecordingPath(name string) (string, error) {
+	reg := regexp.MustCompile("\\W")
+	name = reg.ReplaceAllString(strings.TrimSuffix(name, ".json"), "")
+	if name == "" {
+		return "", errors.New("empty recording name")
+	}
+	return recordingsDir + "/" + name + ".json", nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"encoding/json"
+	"image"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// InputEvent is one line of the input trace written by RecordingControl.
+type InputEvent struct {
+	At       time.Time    `json:"at"`
+	OffsetMs int64        `json:"offset_ms"`
+	Event    string       `json:"event"`
+	Modifier byte         `json:"modifier,omitempty"`
+	Key      string       `json:"key,omitempty"`
+	Keys     []string     `json:"keys,omitempty"`
+	Button   byte         `json:"button,omitempty"`
+	Point    *image.Point `json:"point,omitempty"`
+	Delta    *image.Point `json:"delta,omitempty"`
+	Wheel    byte         `json:"wheel,omitempty"`
+}
+
+const (
+	InputEventSendKey       = "send_key"
+	InputEventSendKeys      = "send_keys"
+	InputEventEndKey        = "end_key"
+	InputEventMouseAbsolute = "mouse_absolute"
+	InputEventMouseEnd      = "mouse_absolute_end"
+	InputEventMouseRelative = "mouse_relative"
+)
+
+// RecordingControl doesn't touch any device, it writes every input event as a JSON line
+// so that a profile run can be inspected or diffed against another one.
+type RecordingControl struct {
+	sync.Mutex
+	w       io.Writer
+	started time.Time
+}
+
+// NewRecordingControl appends the trace to the file, or to stdout when fileName is empty.
+func NewRecordingControl(fileName string) (*RecordingControl, error) {
+	var w io.Writer = os.Stdout
+	if fileName != "" {
+		fh, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = fh
+	}
+	return NewRecordingControlWriter(w), nil
+}
+
+func NewRecordingControlWriter(w io.Writer) *RecordingControl {
+	return &RecordingControl{w: w}
+}
+
+func (c *RecordingControl) SendKey(modifier byte, key string) (n int, err error) {
+	return c.record(InputEvent{Event: InputEventSendKey, Modifier: modifier, Key: key})
+}
+
+func (c *RecordingControl) SendKeys(modifier byte, keys []string) (n int, err error) {
+	return c.record(InputEvent{Event: InputEventSendKeys, Modifier: modifier, Keys: keys})
+}
+
+func (c *RecordingControl) EndKey() (n int, err error) {
+	return c.record(InputEvent{Event: InputEventEndKey})
+}
+
+func (c *RecordingControl) MouseActionAbsolute(pressButton byte, point image.Point, wheel byte) (n int, err error) {
+	return c.record(InputEvent{Event: InputEventMouseAbsolute, Button: pressButton, Point: &point, Wheel: wheel})
+}
+
+func (c *RecordingControl) MouseAbsoluteEnd() (n int, err error) {
+	return c.record(InputEvent{Event: InputEventMouseEnd})
+}
+
+func (c *RecordingControl) MouseActionRelative(pressButton byte, delta image.Point, wheel byte) (n int, err error) {
+	return c.record(InputEvent{Event: InputEventMouseRelative, Button: pressButton, Delta: &delta, Wheel: wheel})
+}
+
+func (c *RecordingControl) record(event InputEvent) (int, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	event.At = time.Now()
+	if c.started.IsZero() {
+		c.started = event.At
+	}
+	event.OffsetMs = event.At.Sub(c.started).Milliseconds()
+	line, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	return c.w.Write(append(line, '\n'))
+}
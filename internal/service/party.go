@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+)
+
+const (
+	partyMaxMembers = 8
+	// AssistPartyMemberLowest as Additional of /assistpartymember targets the member with the lowest HP
+	AssistPartyMemberLowest = "lowest"
+)
+
+// partyStats are the party member stats reported by the server, entity.PartyMember has no mp and cp
+var partyStats = map[string]func(member entity.PartyMember) float64{
+	"hp": func(member entity.PartyMember) float64 { return member.HP.Percent },
+}
+
+func init() {
+	for stat := range partyStats {
+		for i := 1; i <= partyMaxMembers; i++ {
+			conditionFields[fmt.Sprintf("party_member_%s_%d", stat, i)] = partyMemberField(stat, i)
+		}
+		conditionFields["party_min_"+stat] = partyMinField(stat)
+	}
+	conditionFields["party_lowest_member_index"] = func(env ConditionEnv) (float64, bool) {
+		index, ok := PartyLowestMemberIndex(env.Party, "hp")
+		return float64(index), ok
+	}
+	conditionFieldFactories["party_count_below"] = partyCountBelowField
+	conditionFieldFactories["party_lowest_member_index"] = func(args []string) (conditionField, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("party_lowest_member_index expects a stat")
+		}
+		if _, ok := partyStats[args[0]]; !ok {
+			return nil, fmt.Errorf("unknown party stat %q", args[0])
+		}
+		return func(env ConditionEnv) (float64, bool) {
+			index, ok := PartyLowestMemberIndex(env.Party, args[0])
+			return float64(index), ok
+		}, nil
+	}
+}
+
+// partyMember returns the member shown in the given row of the party window, counted from 1.
+func partyMember(party map[uint8]entity.PartyMember, index int) (entity.PartyMember, bool) {
+	val, ok := party[uint8(index+1)] //change count from 0 to 1
+	return val, ok
+}
+
+// PartyMemberStat returns the stat percent of the member, see partyStats.
+func PartyMemberStat(member entity.PartyMember, stat string) (float64, bool) {
+	percent, ok := partyStats[stat]
+	if !ok {
+		return 0, false
+	}
+	return percent(member), true
+}
+
+// PartyLowestMemberIndex returns the party window row of the living member with the lowest stat.
+func PartyLowestMemberIndex(party map[uint8]entity.PartyMember, stat string) (int, bool) {
+	var index int
+	lowest := math.Inf(1)
+	for i := 1; i <= partyMaxMembers; i++ {
+		member, ok := partyMember(party, i)
+		if !ok {
+			continue
+		}
+		if val, ok := PartyMemberStat(member, stat); ok && val > 0 && val < lowest {
+			lowest = val
+			index = i
+		}
+	}
+	return index, index > 0
+}
+
+func partyMemberField(stat string, index int) conditionField {
+	return func(env ConditionEnv) (float64, bool) {
+		member, ok := partyMember(env.Party, index)
+		if !ok {
+			return 0, false
+		}
+		return PartyMemberStat(member, stat)
+	}
+}
+
+func partyMinField(stat string) conditionField {
+	return func(env ConditionEnv) (float64, bool) {
+		index, ok := PartyLowestMemberIndex(env.Party, stat)
+		if !ok {
+			return 0, false
+		}
+		member, _ := partyMember(env.Party, index)
+		return PartyMemberStat(member, stat)
+	}
+}
+
+// partyCountBelowField builds party_count_below(hp,50), the number of living members below the threshold.
+func partyCountBelowField(args []string) (conditionField, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("party_count_below expects a stat and a threshold")
+	}
+	stat := args[0]
+	if _, ok := partyStats[stat]; !ok {
+		return nil, fmt.Errorf("unknown party stat %q", stat)
+	}
+	threshold, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	return func(env ConditionEnv) (float64, bool) {
+		var count float64
+		for i := 1; i <= partyMaxMembers; i++ {
+			member, ok := partyMember(env.Party, i)
+			if !ok {
+				continue
+			}
+			if val, ok := PartyMemberStat(member, stat); ok && val > 0 && val < threshold {
+				count++
+			}
+		}
+		return count, true
+	}, nil
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
 	"io"
 	"os"
 	"regexp"
@@ -23,14 +25,27 @@ const (
 	ActionAITargetNext      = "/aitargetnext"
 	ActionStop              = "/stop"
 	ActionUnstuck           = "/unstuck"
+	ActionDrag              = "/drag"
+	ActionScroll            = "/scroll"
+	ActionRotateCamera      = "/rotatecamera"
+	ActionReplay            = "/replay"
 
 	ConditionCombinatorAnd = "AND"
 	ConditionCombinatorOr  = "OR"
+
+	DefaultHoldUntilMilliseconds = 10000
 )
 
 type ProfileTemplate struct {
 	Items   []ProfileTemplateItem
 	Profile string
+	// Variables are referenced by conditions with the "variable" value source
+	Variables map[string]float64 `json:"variables,omitempty"`
+	// Targets decide which mobs /attack, /targetnext and /aitargetnext keep
+	Targets *TargetRules `json:"targets,omitempty"`
+	// Device is the control device the profile is written for, its resolution bounds the mouse
+	// coordinates. Empty is the default device.
+	Device string `json:"device,omitempty"`
 }
 
 type ProfileTemplateItem struct {
@@ -41,6 +56,17 @@ type ProfileTemplateItem struct {
 	Additional           string
 	Conditions           []Condition
 	ConditionsCombinator string `json:"conditions_combinator"`
+	// Query replaces the flat Conditions, Expression is its text form, e.g. "(my_hp < 40 AND my_mp > 20) OR target_hp = 0"
+	Query      *ConditionGroup `json:"query,omitempty"`
+	Expression string          `json:"expression,omitempty"`
+	// HoldMilliseconds overrides the key_tap timing for the binding of the item
+	HoldMilliseconds int64 `json:"hold_milliseconds,omitempty"`
+	// HoldUntil keeps the binding pressed until the expression is true, at most HoldMilliseconds
+	// or DefaultHoldUntilMilliseconds, e.g. "target_hp = 0"
+	HoldUntil      string          `json:"hold_until,omitempty"`
+	HoldUntilQuery *ConditionGroup `json:"-"`
+	// Priority is used to get the shared device from the runners of other windows, higher first
+	Priority int `json:"priority,omitempty"`
 }
 
 type Condition struct {
@@ -49,15 +75,71 @@ type Condition struct {
 	Operator    string `json:"operator"`
 	ValueSource string `json:"value_source"`
 	Value       string `json:"value"`
+	// ForMilliseconds requires the comparison to hold for at least this long
+	ForMilliseconds int64 `json:"for_milliseconds,omitempty"`
+	// once true, the condition stays true until the field satisfies UntilOperator and UntilValue
+	UntilOperator string `json:"until_operator,omitempty"`
+	UntilValue    string `json:"until_value,omitempty"`
+	// UntilValueSource is the value source of UntilValue, independent of ValueSource
+	UntilValueSource string `json:"until_value_source,omitempty"`
+}
+
+type condition Condition
+
+type queryBuilderCondition struct {
+	condition
+	QueryBuilderValueSource string `json:"valueSource,omitempty"`
+}
+
+// MarshalJSON adds the valueSource key used by react-querybuilder for the sources it knows about.
+func (c Condition) MarshalJSON() ([]byte, error) {
+	body := queryBuilderCondition{condition: condition(c)}
+	switch normalizeValueSource(c.ValueSource) {
+	case ValueSourceLiteral:
+		body.QueryBuilderValueSource = valueSourceQueryBuilderValue
+	case ValueSourceStat:
+		body.QueryBuilderValueSource = valueSourceQueryBuilderField
+	}
+	return json.Marshal(body)
+}
+
+// UnmarshalJSON also accepts the valueSource key used by react-querybuilder, it wins over
+// value_source unless the latter holds a source the query builder doesn't know about.
+func (c *Condition) UnmarshalJSON(data []byte) error {
+	var body queryBuilderCondition
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	*c = Condition(body.condition)
+	switch normalizeValueSource(c.ValueSource) {
+	case ValueSourceLiteral, ValueSourceStat:
+		if body.QueryBuilderValueSource != "" {
+			c.ValueSource = normalizeValueSource(body.QueryBuilderValueSource)
+		}
+	}
+	return nil
 }
 
 func GetProfileData(path string, logger *zap.SugaredLogger) (*ProfileTemplate, error) {
+	profileName, err := GetProfileName(path, logger)
+	if err != nil {
+		return nil, err
+	}
+	return GetProfile(profileName)
+}
+
+// GetProfileName extracts the profile name from request paths like "api/start/<profile>".
+func GetProfileName(path string, logger *zap.SugaredLogger) (string, error) {
 	pathPieces := strings.SplitN(path, "/", 4)
 	if len(pathPieces) < 3 {
 		logger.Infof("invalid request", path)
-		return nil, errors.New("invalid request")
+		return "", errors.New("invalid request")
 	}
-	fileName := getProfilePath(pathPieces[2])
+	return pathPieces[2], nil
+}
+
+func GetProfile(profileName string) (*ProfileTemplate, error) {
+	fileName := getProfilePath(profileName)
 	fh, err := os.OpenFile(fileName, os.O_RDWR, 0600)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, err
@@ -69,16 +151,82 @@ func GetProfileData(path string, logger *zap.SugaredLogger) (*ProfileTemplate, e
 	if err != nil {
 		return nil, err
 	}
+	if err = prepareConditions(templateBody); err != nil {
+		return nil, err
+	}
 	return templateBody, err
 }
 
+func (t *ProfileTemplate) Validate(screen image.Rectangle) error {
+	if err := validateTargetRules(t.Targets, screen); err != nil {
+		return err
+	}
+	for i, item := range t.Items {
+		if err := ValidateConditionGroup(item.Query, t.Variables); err != nil {
+			return fmt.Errorf("item %d: %w", i+1, err)
+		}
+		if item.Binding != "" {
+			if _, err := ParseBinding(item.Binding); err != nil {
+				return fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		if err := validateMouseItem(item, screen); err != nil {
+			return fmt.Errorf("item %d: %w", i+1, err)
+		}
+		if item.Action == ActionReplay {
+			if _, err := getRecordingPath(item.Additional); err != nil {
+				return fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		if item.HoldMilliseconds < 0 {
+			return fmt.Errorf("item %d: negative hold_milliseconds", i+1)
+		}
+		if err := ValidateConditionGroup(item.HoldUntilQuery, t.Variables); err != nil {
+			return fmt.Errorf("item %d: hold_until: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// prepareConditions fills Query of every item from Expression or, for old profiles, from the flat Conditions.
+// When both Expression and a non-empty Query are sent they must describe the same conditions,
+// the UI only sends the one edited last.
+func prepareConditions(templateBody *ProfileTemplate) error {
+	for i := range templateBody.Items {
+		item := &templateBody.Items[i]
+		if item.Expression != "" {
+			query, err := ParseConditionExpression(item.Expression)
+			if err != nil {
+				return fmt.Errorf("item %d: invalid expression: %w", i+1, err)
+			}
+			if item.Query != nil && len(item.Query.Rules) > 0 && item.Query.String() != query.String() {
+				return fmt.Errorf("item %d: expression %q differs from the query %q, clear one of them", i+1, item.Expression, item.Query.String())
+			}
+			item.Query = query
+		}
+		if item.Query == nil {
+			item.Query = NewConditionGroup(item.ConditionsCombinator, item.Conditions)
+		}
+		if item.HoldUntil != "" {
+			query, err := ParseConditionExpression(item.HoldUntil)
+			if err != nil {
+				return fmt.Errorf("item %d: invalid hold_until: %w", i+1, err)
+			}
+			item.HoldUntilQuery = query
+		}
+	}
+	return nil
+}
+
 func getProfilePath(profileName string) string {
 	reg := regexp.MustCompile("\\W")
 	fileName := "var/profiles/" + reg.ReplaceAllString(profileName, "") + ".json" //@todo move to config
 	return fileName
 }
 
-func SaveProfileData(body io.Reader, logger *zap.SugaredLogger) error {
+// SaveProfileData validates the mouse actions coordinates against the screen of the profile device,
+// an empty one skips that check.
+func SaveProfileData(body io.Reader, deviceScreen func(device string) (image.Rectangle, error), logger *zap.SugaredLogger) error {
 	inputBody, err := io.ReadAll(body)
 	if err != nil {
 		logger.Error(err.Error())
@@ -90,7 +238,19 @@ func SaveProfileData(body io.Reader, logger *zap.SugaredLogger) error {
 		logger.Error(err.Error())
 		return err
 	}
-	//@todo validation, save as is for now
+	if err = prepareConditions(&templateBody); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	screen, err := deviceScreen(templateBody.Device)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	if err = templateBody.Validate(screen); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
 	fileName := getProfilePath(templateBody.Profile)
 	tb, err := json.Marshal(templateBody)
 	if err != nil {
@@ -1,7 +1,9 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	http2 "net/http"
 	"sync"
@@ -9,7 +11,6 @@ import (
 
 	"github.com/gibgibik/go-lineage2-macros/internal/core/http"
 	"github.com/gibgibik/go-lineage2-server/pkg/entity"
-	"go.uber.org/zap"
 )
 
 var (
@@ -19,6 +20,32 @@ var (
 	fullTargetHpUnchangedSince time.Time
 )
 
+const (
+	EndpointInit                   = "init"
+	EndpointFindBounds             = "findBounds"
+	EndpointGetCurrentTarget       = "getCurrentTarget"
+	EndpointGetForegroundWindowPid = "getForegroundWindowPid"
+)
+
+var (
+	ErrServerUnavailable = errors.New("server unavailable")
+	ErrInvalidResponse   = errors.New("invalid server response")
+)
+
+// ServerError tells which endpoint failed, it wraps ErrServerUnavailable, ErrInvalidResponse or the context error.
+type ServerError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *ServerError) Error() string {
+	return e.Endpoint + ": " + e.Err.Error()
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
 type BoundsResult struct {
 	Boxes [][]int `json:"boxes"`
 }
@@ -65,60 +92,63 @@ type ForeGroundWindowInfo struct {
 //	}
 //}
 
-func FindBounds(logger *zap.SugaredLogger) (*BoundsResult, error) {
-	var err error
-	logger.Info("get bounds start")
-	bounds, err := http.HttpCl.RawRequest("findBounds", http2.MethodGet, nil)
-	logger.Info("get bounds end")
-	if err != nil {
+// ServerClient calls the endpoints of go-lineage2-server.
+type ServerClient interface {
+	Init(ctx context.Context) (InitData, error)
+	// FindBounds returns the boxes of the mobs found on the screen
+	FindBounds(ctx context.Context) (*BoundsResult, error)
+	// GetCurrentTarget returns the name of the selected target, empty if none
+	GetCurrentTarget(ctx context.Context) (string, error)
+	GetForegroundWindowPid(ctx context.Context) (uint32, error)
+}
+
+type httpServerClient struct {
+	cl *http.HttpClient
+}
+
+func NewServerClient(cl *http.HttpClient) ServerClient {
+	return &httpServerClient{cl: cl}
+}
+
+func (c *httpServerClient) Init(ctx context.Context) (InitData, error) {
+	var result InitData
+	err := c.request(ctx, EndpointInit, http2.MethodGet, &result)
+	return result, err
+}
+
+func (c *httpServerClient) FindBounds(ctx context.Context) (*BoundsResult, error) {
+	var result BoundsResult
+	if err := c.request(ctx, EndpointFindBounds, http2.MethodGet, &result); err != nil {
 		return nil, err
 	}
-	var boxes BoundsResult
-	err = json.Unmarshal(bounds, &boxes)
-	if err != nil {
-		logger.Error("parse bounds json error: ", err.Error())
-		return nil, nil
-	}
-	//if len(boxes.Boxes) > 10 {
-	//	boxes.Boxes = boxes.Boxes[:10]
-	//}
-	return &boxes, nil
+	return &result, nil
 }
 
-func GetCurrentTarget(logger *zap.SugaredLogger) (string, error) {
-	var err error
-	result, err := http.HttpCl.RawRequest("getCurrentTarget", http2.MethodGet, nil)
-	if err != nil {
-		return "", err
-	}
-	var name struct {
+func (c *httpServerClient) GetCurrentTarget(ctx context.Context) (string, error) {
+	var result struct {
 		Name string `json:"name"`
 	}
-	err = json.Unmarshal(result, &name)
-	if err != nil {
-		logger.Error("parse bounds json error: ", err.Error())
-		return "", nil
-	}
-	return name.Name, nil
+	err := c.request(ctx, EndpointGetCurrentTarget, http2.MethodGet, &result)
+	return result.Name, err
 }
 
-func Init() (InitData, error) {
-	var result InitData
-	initData, err := http.HttpCl.RawRequest("init", http2.MethodGet, nil)
-	if err != nil {
-		return InitData{}, err
-	}
-	_ = json.Unmarshal(initData, &result)
-	return result, nil
+func (c *httpServerClient) GetForegroundWindowPid(ctx context.Context) (uint32, error) {
+	var result ForeGroundWindowInfo
+	err := c.request(ctx, EndpointGetForegroundWindowPid, http2.MethodPost, &result)
+	return result.Pid, err
 }
-func GetForegroundWindowPid() (uint32, error) {
-	res, err := http.HttpCl.RawRequest("getForegroundWindowPid", http2.MethodPost, nil)
-	//fmt.Println("get foreground", string(res))
+
+// request calls the endpoint and decodes its JSON response into result.
+func (c *httpServerClient) request(ctx context.Context, endpoint string, method string, result any) error {
+	body, err := c.cl.RawRequest(ctx, endpoint, method, nil)
 	if err != nil {
-		fmt.Println("err", err)
-		return 0, err
+		if ctx.Err() != nil {
+			return &ServerError{Endpoint: endpoint, Err: ctx.Err()}
+		}
+		return &ServerError{Endpoint: endpoint, Err: fmt.Errorf("%w: %w", ErrServerUnavailable, err)}
 	}
-	var result ForeGroundWindowInfo
-	_ = json.Unmarshal(res, &result)
-	return result.Pid, nil
+	if err := json.Unmarshal(body, result); err != nil {
+		return &ServerError{Endpoint: endpoint, Err: fmt.Errorf("%w: %w", ErrInvalidResponse, err)}
+	}
+	return nil
 }
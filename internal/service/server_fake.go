@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeServerClient is an in-memory ServerClient, it answers with the values set on it.
+type FakeServerClient struct {
+	mutex         sync.Mutex
+	initData      InitData
+	bounds        BoundsResult
+	target        string
+	foregroundPid uint32
+	errs          map[string]error
+	calls         map[string]int
+}
+
+func NewFakeServerClient() *FakeServerClient {
+	return &FakeServerClient{
+		errs:  make(map[string]error),
+		calls: make(map[string]int),
+	}
+}
+
+func (f *FakeServerClient) SetInitData(data InitData) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.initData = data
+}
+
+func (f *FakeServerClient) SetBounds(boxes [][]int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.bounds = BoundsResult{Boxes: boxes}
+}
+
+func (f *FakeServerClient) SetCurrentTarget(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.target = name
+}
+
+func (f *FakeServerClient) SetForegroundWindowPid(pid uint32) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.foregroundPid = pid
+}
+
+// SetError makes the endpoint fail with err, nil makes it answer again.
+func (f *FakeServerClient) SetError(endpoint string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err == nil {
+		delete(f.errs, endpoint)
+		return
+	}
+	f.errs[endpoint] = &ServerError{Endpoint: endpoint, Err: err}
+}
+
+// Calls returns how many times the endpoint was called.
+func (f *FakeServerClient) Calls(endpoint string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[endpoint]
+}
+
+func (f *FakeServerClient) Init(ctx context.Context) (InitData, error) {
+	if err := f.call(ctx, EndpointInit); err != nil {
+		return InitData{}, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.initData, nil
+}
+
+func (f *FakeServerClient) FindBounds(ctx context.Context) (*BoundsResult, error) {
+	if err := f.call(ctx, EndpointFindBounds); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	bounds := BoundsResult{Boxes: append([][]int(nil), f.bounds.Boxes...)}
+	return &bounds, nil
+}
+
+func (f *FakeServerClient) GetCurrentTarget(ctx context.Context) (string, error) {
+	if err := f.call(ctx, EndpointGetCurrentTarget); err != nil {
+		return "", err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.target, nil
+}
+
+func (f *FakeServerClient) GetForegroundWindowPid(ctx context.Context) (uint32, error) {
+	if err := f.call(ctx, EndpointGetForegroundWindowPid); err != nil {
+		return 0, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.foregroundPid, nil
+}
+
+func (f *FakeServerClient) call(ctx context.Context, endpoint string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls[endpoint]++
+	if err := ctx.Err(); err != nil {
+		return &ServerError{Endpoint: endpoint, Err: err}
+	}
+	return f.errs[endpoint]
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+)
+
+// guarded by PlayerStatsMutex
+var (
+	playerStatsReceivedAt = make(map[uint32]time.Time)
+	playerStatsHistory    = make(map[uint32]*StatHistory)
+)
+
+// UpdatePlayerStats merges the stats pushed to /api/stats and stamps every reported PID with now.
+func UpdatePlayerStats(body []byte, now time.Time) error {
+	var stats entity.StatStr
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return err
+	}
+	PlayerStatsMutex.Lock()
+	defer PlayerStatsMutex.Unlock()
+	if PlayerStats.Player == nil {
+		PlayerStats.Player = make(map[uint32]entity.PlayerStat)
+	}
+	for pid, stat := range stats.Player {
+		PlayerStats.Player[pid] = stat
+		playerStatsReceivedAt[pid] = now
+		if _, ok := playerStatsHistory[pid]; !ok {
+			playerStatsHistory[pid] = NewStatHistory(statHistorySize)
+		}
+		playerStatsHistory[pid].Add(StatSample{At: now, Stat: stat})
+	}
+	if stats.Party != nil {
+		PlayerStats.Party = stats.Party
+	}
+	return nil
+}
+
+// PushedStats reads the stats pushed by the server to /api/stats.
+type PushedStats struct{}
+
+func (PushedStats) PlayerStat(pid uint32) *entity.PlayerStat {
+	PlayerStatsMutex.Lock()
+	defer PlayerStatsMutex.Unlock()
+	if val, ok := PlayerStats.Player[pid]; ok {
+		return &val
+	}
+	return nil
+}
+
+func (PushedStats) Party() map[uint8]entity.PartyMember {
+	PlayerStatsMutex.Lock()
+	defer PlayerStatsMutex.Unlock()
+	return maps.Clone(PlayerStats.Party)
+}
+
+// ReceivedAt returns the zero time if nothing was received for the PID yet.
+func (PushedStats) ReceivedAt(pid uint32) time.Time {
+	PlayerStatsMutex.Lock()
+	defer PlayerStatsMutex.Unlock()
+	return playerStatsReceivedAt[pid]
+}
+
+// History returns the samples of the PID within the rate window, oldest first.
+func (PushedStats) History(pid uint32, now time.Time) []StatSample {
+	PlayerStatsMutex.Lock()
+	history, ok := playerStatsHistory[pid]
+	PlayerStatsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return history.Since(now.Add(-statRateWindow))
+}
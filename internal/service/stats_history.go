@@ -0,0 +1,107 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+)
+
+const (
+	statHistorySize = 128
+	// statRateWindow is how far back the rate of change fields look
+	statRateWindow = 3 * time.Second
+)
+
+type StatSample struct {
+	At   time.Time
+	Stat entity.PlayerStat
+}
+
+// StatHistory is a ring buffer of the latest stat samples of one PID.
+type StatHistory struct {
+	mu      sync.Mutex
+	samples []StatSample
+	next    int
+	full    bool
+}
+
+func NewStatHistory(size int) *StatHistory {
+	return &StatHistory{samples: make([]StatSample, size)}
+}
+
+func (h *StatHistory) Add(sample StatSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Since returns the samples not older than t, oldest first.
+func (h *StatHistory) Since(t time.Time) []StatSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var result []StatSample
+	start, count := 0, h.next
+	if h.full {
+		start, count = h.next, len(h.samples)
+	}
+	for i := 0; i < count; i++ {
+		sample := h.samples[(start+i)%len(h.samples)]
+		if !sample.At.Before(t) {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+func init() {
+	conditionFields["my_hp_delta_per_sec"] = rateField(func(stat entity.PlayerStat) float64 { return stat.HP.Percent })
+	conditionFields["my_mp_delta_per_sec"] = rateField(func(stat entity.PlayerStat) float64 { return stat.MP.Percent })
+	conditionFields["target_hp_delta_per_sec"] = rateField(func(stat entity.PlayerStat) float64 { return stat.Target.HpPercent })
+	// percent per second the target loses, negative if it heals
+	conditionFields["target_hp_drop_rate"] = func(env ConditionEnv) (float64, bool) {
+		rate, ok := statRate(env.History, func(stat entity.PlayerStat) float64 { return stat.Target.HpPercent })
+		return -rate, ok
+	}
+	// estimated milliseconds until the target dies at the current drop rate
+	conditionFields["target_time_to_death"] = func(env ConditionEnv) (float64, bool) {
+		rate, ok := statRate(env.History, func(stat entity.PlayerStat) float64 { return stat.Target.HpPercent })
+		if !ok || rate >= 0 || env.Stat.Target.HpPercent <= 0 {
+			return 0, false
+		}
+		return env.Stat.Target.HpPercent / -rate * 1000, true
+	}
+}
+
+func rateField(value func(stat entity.PlayerStat) float64) conditionField {
+	return func(env ConditionEnv) (float64, bool) {
+		return statRate(env.History, value)
+	}
+}
+
+// statRate is the least squares slope of the value per second over the samples.
+func statRate(samples []StatSample, value func(stat entity.PlayerStat) float64) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	origin := samples[0].At
+	for _, sample := range samples {
+		x := sample.At.Sub(origin).Seconds()
+		y := value(sample.Stat)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gibgibik/go-lineage2-server/pkg/entity"
+)
+
+// TargetRules decide which targets a profile hunts for. Names are compared case-insensitively,
+// patterns are regular expressions. A target is rejected when it's friendly, denied, or when
+// an allow list is given and it matches none of it.
+type TargetRules struct {
+	Allow         []string `json:"allow,omitempty"`
+	Deny          []string `json:"deny,omitempty"`
+	AllowPatterns []string `json:"allow_patterns,omitempty"`
+	DenyPatterns  []string `json:"deny_patterns,omitempty"`
+	// AllowFriendly lets party members and own characters be targeted, they're rejected by default
+	AllowFriendly bool `json:"allow_friendly,omitempty"`
+	// Scoring orders the boxes found by /aitargetnext
+	Scoring *TargetScoring `json:"scoring,omitempty"`
+	// ClickOffset is added to the top center of a found box to click the mob, 0,30 by default
+	ClickOffset *TargetPoint `json:"click_offset,omitempty"`
+	// BlacklistMilliseconds is how long a rejected or stuck target is skipped, 60000 by default
+	BlacklistMilliseconds int64 `json:"blacklist_milliseconds,omitempty"`
+	// FullHpTimeoutMilliseconds is how long an attacked target may stay at full HP, 15000 by default
+	FullHpTimeoutMilliseconds int64 `json:"full_hp_timeout_milliseconds,omitempty"`
+}
+
+// Targeting evaluates the TargetRules of a profile.
+type Targeting struct {
+	rules         TargetRules
+	allow         map[string]bool
+	deny          map[string]bool
+	allowPatterns []*regexp.Regexp
+	denyPatterns  []*regexp.Regexp
+	scoring       TargetScoring
+	clickOffset   TargetPoint
+	priority      map[string]int
+	seen          []seenTarget
+	// blacklist holds the time the blacklisted targets are allowed again
+	blacklist         map[blacklistKey]blacklistEntry
+	blacklistDuration time.Duration
+	fullHpTimeout     time.Duration
+}
+
+// NewTargeting compiles the rules, nil rules allow any target but the friendly ones.
+func NewTargeting(rules *TargetRules) (*Targeting, error) {
+	t := &Targeting{blacklist: make(map[blacklistKey]blacklistEntry)}
+	if err := t.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetRules replaces the rules, e.g. when the profile is reloaded. The blacklist and the remembered
+// click outcomes are kept, so saving a profile doesn't bring the skipped targets back.
+func (t *Targeting) SetRules(rules *TargetRules) error {
+	compiled := Targeting{
+		allow:       make(map[string]bool),
+		deny:        make(map[string]bool),
+		scoring:     defaultTargetScoring,
+		clickOffset: defaultTargetClickOffset,
+		priority:    make(map[string]int),
+
+		blacklistDuration: defaultTargetBlacklistDuration,
+		fullHpTimeout:     defaultTargetFullHpTimeout,
+	}
+	if err := compiled.compile(rules); err != nil {
+		return err
+	}
+	compiled.seen = t.seen
+	compiled.blacklist = t.blacklist
+	*t = compiled
+	return nil
+}
+
+func (t *Targeting) compile(rules *TargetRules) error {
+	if rules == nil {
+		return nil
+	}
+	t.rules = *rules
+	if rules.BlacklistMilliseconds > 0 {
+		t.blacklistDuration = time.Duration(rules.BlacklistMilliseconds) * time.Millisecond
+	}
+	if rules.FullHpTimeoutMilliseconds > 0 {
+		t.fullHpTimeout = time.Duration(rules.FullHpTimeoutMilliseconds) * time.Millisecond
+	}
+	if rules.Scoring != nil {
+		t.scoring = *rules.Scoring
+	}
+	if rules.ClickOffset != nil {
+		t.clickOffset = *rules.ClickOffset
+	}
+	for i, name := range t.scoring.Priority {
+		if _, ok := t.priority[normalizeTargetName(name)]; !ok {
+			t.priority[normalizeTargetName(name)] = i
+		}
+	}
+	for _, name := range rules.Allow {
+		t.allow[normalizeTargetName(name)] = true
+	}
+	for _, name := range rules.Deny {
+		t.deny[normalizeTargetName(name)] = true
+	}
+	var err error
+	if t.allowPatterns, err = compileTargetPatterns(rules.AllowPatterns); err != nil {
+		return err
+	}
+	t.denyPatterns, err = compileTargetPatterns(rules.DenyPatterns)
+	return err
+}
+
+// Check reports whether the target may be attacked, with the reason when it may not.
+// Friendly holds the names of the party members and own characters.
+func (t *Targeting) Check(name string, friendly []string) (bool, string) {
+	normalized := normalizeTargetName(name)
+	if normalized == "" {
+		return false, "no target"
+	}
+	if !t.rules.AllowFriendly {
+		for _, friend := range friendly {
+			if normalizeTargetName(friend) == normalized {
+				return false, "friendly target"
+			}
+		}
+	}
+	if t.deny[normalized] || matchTargetPatterns(t.denyPatterns, name) {
+		return false, "denied target"
+	}
+	if len(t.allow) == 0 && len(t.allowPatterns) == 0 {
+		return true, ""
+	}
+	if t.allow[normalized] || matchTargetPatterns(t.allowPatterns, name) {
+		return true, ""
+	}
+	return false, "target isn't allowed"
+}
+
+// PartyMemberNames returns the names of the party members, the unnamed ones are skipped.
+func PartyMemberNames(party map[uint8]entity.PartyMember) []string {
+	var names []string
+	for _, member := range party {
+		if member.Name != "" {
+			names = append(names, member.Name)
+		}
+	}
+	return names
+}
+
+func validateTargetRules(rules *TargetRules, screen image.Rectangle) error {
+	if rules == nil {
+		return nil
+	}
+	if err := validateTargetScoring(rules.Scoring, screen); err != nil {
+		return err
+	}
+	if rules.BlacklistMilliseconds < 0 || rules.FullHpTimeoutMilliseconds < 0 {
+		return errors.New("target blacklist and full hp timeouts can't be negative")
+	}
+	if _, err := compileTargetPatterns(rules.AllowPatterns); err != nil {
+		return err
+	}
+	_, err := compileTargetPatterns(rules.DenyPatterns)
+	return err
+}
+
+func compileTargetPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		reg, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target pattern %q: %w", pattern, err)
+		}
+		result = append(result, reg)
+	}
+	return result, nil
+}
+
+func matchTargetPatterns(patterns []*regexp.Regexp, name string) bool {
+	for _, reg := range patterns {
+		if reg.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeTargetName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"image"
+	"time"
+)
+
+const (
+	// targetRegionPx is the size of the screen cells the blacklisted targets are keyed by
+	targetRegionPx                 = 100
+	defaultTargetBlacklistDuration = time.Minute
+	defaultTargetFullHpTimeout     = 15 * time.Second
+)
+
+type blacklistKey struct {
+	name   string
+	region image.Point
+	// anywhere keys the targets blacklisted by name only, region is unused then
+	anywhere bool
+}
+
+type blacklistEntry struct {
+	point image.Point
+	until time.Time
+}
+
+// Blacklist skips the target in the screen region of point for BlacklistMilliseconds.
+func (t *Targeting) Blacklist(name string, point image.Point, now time.Time) {
+	t.blacklist[blacklistKey{name: normalizeTargetName(name), region: targetRegion(point)}] = blacklistEntry{point: point, until: now.Add(t.blacklistDuration)}
+}
+
+// BlacklistName skips every target of the name for BlacklistMilliseconds, for the targets whose
+// position on the screen isn't known, e.g. the ones selected by /targetnext or /assist.
+func (t *Targeting) BlacklistName(name string, now time.Time) {
+	t.blacklist[blacklistKey{name: normalizeTargetName(name), anywhere: true}] = blacklistEntry{until: now.Add(t.blacklistDuration)}
+}
+
+// Blacklisted reports whether the target in the screen region of point is blacklisted.
+// An empty name is the intended fallback before a found box is clicked, when its name isn't known
+// yet: it only matches a target blacklisted within targetNearPx of point, as any closer box is
+// likely the same mob, so a dense spawn isn't skipped as a whole. The name must be checked again
+// once the target is selected.
+func (t *Targeting) Blacklisted(name string, point image.Point, now time.Time) bool {
+	region := targetRegion(point)
+	name = normalizeTargetName(name)
+	for key, entry := range t.blacklist {
+		if !now.Before(entry.until) {
+			delete(t.blacklist, key)
+			continue
+		}
+		if key.anywhere {
+			if key.name == name {
+				return true
+			}
+			continue
+		}
+		if name == "" && distance(entry.point, point) <= targetNearPx {
+			return true
+		}
+		if name != "" && key.name == name && key.region == region {
+			return true
+		}
+	}
+	return false
+}
+
+// BlacklistedName reports whether the target, selected at an unknown position, was blacklisted by name.
+func (t *Targeting) BlacklistedName(name string, now time.Time) bool {
+	name = normalizeTargetName(name)
+	for key, entry := range t.blacklist {
+		if !now.Before(entry.until) {
+			delete(t.blacklist, key)
+			continue
+		}
+		if key.anywhere && key.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FullHpTimeout is how long a target may stay at full HP while attacked before it's blacklisted.
+func (t *Targeting) FullHpTimeout() time.Duration {
+	return t.fullHpTimeout
+}
+
+func targetRegion(point image.Point) image.Point {
+	return point.Div(targetRegionPx)
+}
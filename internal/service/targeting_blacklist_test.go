@@ -0,0 +1,93 @@
+package service
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func TestBlacklisted(t *testing.T) {
+	targeting, err := NewTargeting(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	targeting.Blacklist("Elder Ant", image.Pt(410, 320), now)
+
+	tests := []struct {
+		name  string
+		point image.Point
+		at    time.Duration
+		want  bool
+	}{
+		{"elder ant", image.Pt(450, 350), 0, true},
+		{"", image.Pt(430, 340), 0, true},
+		{"", image.Pt(480, 380), 0, false},
+		{"", image.Pt(450, 350), 0, false},
+		{"Giant Spider", image.Pt(450, 350), 0, false},
+		{"Elder Ant", image.Pt(520, 350), 0, false},
+		{"Elder Ant", image.Pt(410, 320), time.Minute, false},
+	}
+	for _, test := range tests {
+		if got := targeting.Blacklisted(test.name, test.point, now.Add(test.at)); got != test.want {
+			t.Errorf("Blacklisted(%q, %v, +%s) = %v, want %v", test.name, test.point, test.at, got, test.want)
+		}
+	}
+}
+
+func TestBlacklistName(t *testing.T) {
+	targeting, err := NewTargeting(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	targeting.BlacklistName("Elder Ant", now)
+	if !targeting.BlacklistedName("elder ant", now) || !targeting.Blacklisted("Elder Ant", image.Pt(700, 500), now) {
+		t.Error("target blacklisted by name isn't skipped everywhere")
+	}
+	if targeting.BlacklistedName("Giant Spider", now) || targeting.Blacklisted("", image.Pt(700, 500), now) {
+		t.Error("blacklisting by name skips other targets")
+	}
+	if targeting.BlacklistedName("Elder Ant", now.Add(time.Minute)) {
+		t.Error("blacklisting by name doesn't expire")
+	}
+}
+
+func TestSetRulesKeepsBlacklist(t *testing.T) {
+	targeting, err := NewTargeting(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	targeting.Blacklist("Elder Ant", image.Pt(410, 320), now)
+	targeting.Remember(image.Pt(600, 300), "", true, now)
+	if err := targeting.SetRules(&TargetRules{Deny: []string{"Giant Spider"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !targeting.Blacklisted("Elder Ant", image.Pt(410, 320), now) || !targeting.failedNear(image.Pt(600, 300)) {
+		t.Error("SetRules forgot the blacklist or the failed clicks")
+	}
+	if ok, _ := targeting.Check("Giant Spider", nil); ok {
+		t.Error("SetRules didn't apply the new rules")
+	}
+	if err := targeting.SetRules(&TargetRules{AllowPatterns: []string{"("}}); err == nil {
+		t.Error("SetRules accepted an invalid pattern")
+	}
+}
+
+func TestRankBoxesCandidateName(t *testing.T) {
+	targeting, err := NewTargeting(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	targeting.Remember(image.Pt(130, 130), "Elder Ant", false, now)
+	candidates := targeting.RankBoxes([][]int{{100, 100, 160, 120}, {600, 400, 660, 420}}, image.Rect(0, 0, 800, 600), now)
+	names := make(map[image.Point]string, len(candidates))
+	for _, candidate := range candidates {
+		names[candidate.Click] = candidate.Name
+	}
+	if names[image.Pt(130, 130)] != "elder ant" || names[image.Pt(630, 430)] != "" {
+		t.Errorf("candidate names = %v, want elder ant near the remembered click only", names)
+	}
+}
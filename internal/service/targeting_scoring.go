@@ -0,0 +1,170 @@
+package service
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// targetMemory is how long the clicked positions are remembered for the scoring
+	targetMemory     = 30 * time.Second
+	targetMemorySize = 32
+	// targetNearPx is how close a box must be to a remembered position to be considered the same mob
+	targetNearPx = 40
+)
+
+var (
+	defaultTargetScoring = TargetScoring{
+		DistanceWeight: 1,
+		SizeWeight:     0.25,
+		FailedWeight:   1,
+		PriorityWeight: 1,
+	}
+	// the detector boxes start at the name plate, the mob is below it
+	defaultTargetClickOffset = TargetPoint{X: 0, Y: 30}
+)
+
+type TargetPoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// TargetScoring orders the boxes found by /aitargetnext, the best scored box is clicked first.
+// Nil scoring uses the default weights, a zero weight disables its criterion.
+type TargetScoring struct {
+	// DistanceWeight prefers the boxes close to the anchor
+	DistanceWeight float64 `json:"distance_weight"`
+	// SizeWeight prefers the large boxes, which are usually the close mobs
+	SizeWeight float64 `json:"size_weight"`
+	// FailedWeight avoids the positions where a click recently gave no target or a wrong one
+	FailedWeight float64 `json:"failed_weight"`
+	// PriorityWeight prefers the positions where a mob listed in Priority was recently identified
+	PriorityWeight float64 `json:"priority_weight"`
+	// Priority lists the mob names, the most wanted first
+	Priority []string `json:"priority,omitempty"`
+	// Anchor is the character position on the screen, the screen center by default
+	Anchor *TargetPoint `json:"anchor,omitempty"`
+}
+
+// TargetCandidate is a box found on the screen with the point to click to target it.
+type TargetCandidate struct {
+	Box   image.Rectangle
+	Click image.Point
+	Score float64
+	// Name is the target last identified near Click, empty when it's unknown until the box is clicked
+	Name string
+}
+
+type seenTarget struct {
+	point  image.Point
+	name   string
+	failed bool
+	at     time.Time
+}
+
+// RankBoxes converts the FindBounds boxes to candidates ordered by score, the detector order is kept on ties.
+func (t *Targeting) RankBoxes(boxes [][]int, screen image.Rectangle, now time.Time) []TargetCandidate {
+	t.forget(now)
+	anchor := screenCenter(screen)
+	if t.scoring.Anchor != nil {
+		anchor = image.Point{X: t.scoring.Anchor.X, Y: t.scoring.Anchor.Y}
+	}
+	candidates := make([]TargetCandidate, 0, len(boxes))
+	maxArea, maxDistance := 1.0, 1.0
+	for _, box := range boxes {
+		if len(box) < 4 {
+			continue
+		}
+		rect := image.Rect(box[0], box[1], box[2], box[3])
+		if rect.Empty() {
+			continue
+		}
+		click := image.Point{X: rect.Min.X + rect.Dx()/2 + t.clickOffset.X, Y: rect.Min.Y + t.clickOffset.Y}
+		candidates = append(candidates, TargetCandidate{Box: rect, Click: click})
+		maxArea = math.Max(maxArea, float64(rect.Dx()*rect.Dy()))
+		maxDistance = math.Max(maxDistance, distance(click, anchor))
+	}
+	for i := range candidates {
+		candidate := &candidates[i]
+		candidate.Score = t.scoring.SizeWeight*float64(candidate.Box.Dx()*candidate.Box.Dy())/maxArea -
+			t.scoring.DistanceWeight*distance(candidate.Click, anchor)/maxDistance +
+			t.scoring.PriorityWeight*t.priorityNear(candidate.Click)
+		if t.failedNear(candidate.Click) {
+			candidate.Score -= t.scoring.FailedWeight
+		}
+		candidate.Name = t.nameNear(candidate.Click)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return candidates
+}
+
+// Remember records the outcome of a click, failed when it gave no target or a wrong one.
+func (t *Targeting) Remember(point image.Point, name string, failed bool, now time.Time) {
+	t.forget(now)
+	if len(t.seen) >= targetMemorySize {
+		t.seen = t.seen[1:]
+	}
+	t.seen = append(t.seen, seenTarget{point: point, name: normalizeTargetName(name), failed: failed, at: now})
+}
+
+func (t *Targeting) forget(now time.Time) {
+	i := 0
+	for i < len(t.seen) && now.Sub(t.seen[i].at) > targetMemory {
+		i++
+	}
+	t.seen = t.seen[i:]
+}
+
+func (t *Targeting) failedNear(point image.Point) bool {
+	for _, seen := range t.seen {
+		if seen.failed && distance(seen.point, point) <= targetNearPx {
+			return true
+		}
+	}
+	return false
+}
+
+// nameNear returns the name of the latest target identified near the point.
+func (t *Targeting) nameNear(point image.Point) string {
+	for i := len(t.seen) - 1; i >= 0; i-- {
+		if t.seen[i].name != "" && distance(t.seen[i].point, point) <= targetNearPx {
+			return t.seen[i].name
+		}
+	}
+	return ""
+}
+
+// priorityNear returns 1 for the most wanted mob identified near the point down to 0 for an unlisted one.
+func (t *Targeting) priorityNear(point image.Point) float64 {
+	result := 0.0
+	for _, seen := range t.seen {
+		rank, ok := t.priority[seen.name]
+		if seen.failed || !ok || distance(seen.point, point) > targetNearPx {
+			continue
+		}
+		result = math.Max(result, float64(len(t.priority)-rank)/float64(len(t.priority)))
+	}
+	return result
+}
+
+func validateTargetScoring(scoring *TargetScoring, screen image.Rectangle) error {
+	if scoring == nil {
+		return nil
+	}
+	if scoring.DistanceWeight < 0 || scoring.SizeWeight < 0 || scoring.FailedWeight < 0 || scoring.PriorityWeight < 0 {
+		return errors.New("target scoring weights can't be negative")
+	}
+	if scoring.Anchor != nil {
+		return checkScreenPoint(image.Point{X: scoring.Anchor.X, Y: scoring.Anchor.Y}, screen)
+	}
+	return nil
+}
+
+func distance(a, b image.Point) float64 {
+	return math.Hypot(float64(a.X-b.X), float64(a.Y-b.Y))
+}
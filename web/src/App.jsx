@@ -18,7 +18,7 @@ import {
 import {Log} from "./Log.jsx";
 import {Macros} from "./Macros.jsx";
 import {useEffect, useState} from "react";
-import {init, pauseMacros, startMacros, stopMacros} from "./api.js";
+import {getStatus, init, pauseMacros, startMacros, stopMacros} from "./api.js";
 import {Profiles} from "./Profile.jsx";
 
 const theme = createTheme({
@@ -39,6 +39,7 @@ function App() {
     const [pidsData, setPidData] = useState([]);
     const [currentPid, setCurrentPid] = useState(null);
     const [runningMacrosState, setRunningMacrosState] = useState({});
+    const [runnersState, setRunnersState] = useState({});
     const startMacrosAction = () => {
         setDisabledStart(true);
         const stFunc = async () => {
@@ -82,6 +83,22 @@ function App() {
             setDisabledStart(true);
         })
     }, []);
+    useEffect(() => {
+        const interval = setInterval(() => {
+            getStatus().then(({data = []}) => {
+                const states = {};
+                data.forEach(({pid, state, error, holds_device}) => {
+                    states[pid] = error ? `${state}: ${error}` : state;
+                    if (holds_device) {
+                        states[pid] += ' (holds device)';
+                    }
+                });
+                setRunnersState(states);
+            }).catch(() => {
+            });
+        }, 2000);
+        return () => clearInterval(interval);
+    }, []);
     return (
         <ThemeProvider theme={theme}>
             <CssBaseline/>
@@ -103,7 +120,7 @@ function App() {
                                 }}
                             >
                                 {Object.keys(pidsData).map((index) => <MenuItem key={index}
-                                                                                value={index}>{`${index} - ${pidsData[index]}`}</MenuItem>)}
+                                                                                value={index}>{`${index} - ${pidsData[index]}${runnersState[index] ? ` (${runnersState[index]})` : ''}`}</MenuItem>)}
                             </Select>
                         </FormControl>
                         <Button color={'error'} onClick={() => stopMacrosAction(parseInt(currentPid))} disabled={runningMacrosState[currentPid]}>Stop</Button>
@@ -16,24 +16,41 @@ const fields = [
     {name: 'party_member_hp_5', label: 'Party Member 5 HP'},
     {name: 'party_member_hp_6', label: 'Party Member 6 HP'},
     {name: 'party_member_hp_7', label: 'Party Member 7 HP'},
-    {name: 'party_member_hp_8', label: 'Party Member 8 HP'}
-];
-
-const controlElements = {
-    addGroupAction: () => null,
-}
+    {name: 'party_member_hp_8', label: 'Party Member 8 HP'},
+    {name: 'party_min_hp', label: 'Party Min HP'},
+    {name: 'party_lowest_member_index', label: 'Party Lowest HP Member'},
+    {name: 'party_count_below(hp,50)', label: 'Party Members Below 50% HP'},
+    {name: 'my_hp_delta_per_sec', label: 'My HP Change %/s'},
+    {name: 'my_mp_delta_per_sec', label: 'My MP Change %/s'},
+    {name: 'target_hp_delta_per_sec', label: 'Target HP Change %/s'},
+    {name: 'target_hp_drop_rate', label: 'Target HP Drop %/s'},
+    {name: 'target_time_to_death', label: 'Target Time To Death (ms)'},
+].map((field) => ({...field, valueSources: ['value', 'field']}));
 
 const operators = [
     {name: '>', label: '>'},
+    {name: '>=', label: '>='},
     {name: '=', label: '='},
+    {name: '!=', label: '!='},
     {name: '<', label: '<'},
+    {name: '<=', label: '<='},
+    {name: 'between', label: 'between'},
+    {name: 'outside', label: 'outside'},
+    {name: 'rose_by_pct', label: 'rose by %'},
+    {name: 'fell_by_pct', label: 'fell by %'},
 ];
 const combinators = [
     {name: 'AND', label: 'AND'},
     {name: 'OR', label: 'OR'},
 ];
+const buttonLabel = (className = '') => {
+    if (className.includes('rule-remove') || className.includes('ruleGroup-remove')) {
+        return '-';
+    }
+    return className.includes('ruleGroup-addGroup') ? '+()' : '+';
+}
 const muiComponents = {
-    Button: (props) => <Button onClick={props.onClick}>{props.className === 'rule-remove' ? '-' : '+'}</Button>
+    Button: (props) => <Button onClick={props.onClick}>{buttonLabel(props.className)}</Button>
 };
 export const Condition = ({onQueryChange, fullWidth, conditions}) => {
     const [query, setQuery] = useState(conditions);
@@ -41,12 +58,12 @@ export const Condition = ({onQueryChange, fullWidth, conditions}) => {
         setQuery(conditions);
     }, [conditions]);
     useEffect(() => {
-        onQueryChange(query.rules, 'json');
+        onQueryChange(query, 'json');
     }, [query]);
     return (
         <FormControl fullWidth={fullWidth}>
             <QueryBuilderMaterial muiComponents={muiComponents}>
-                <QueryBuilder fields={fields} query={query} onQueryChange={setQuery} controlElements={controlElements}
+                <QueryBuilder fields={fields} query={query} onQueryChange={setQuery} showNotToggle
                               operators={operators} combinators={combinators}/>
             </QueryBuilderMaterial>
         </FormControl>
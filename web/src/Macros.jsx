@@ -3,6 +3,7 @@ import {MacrosAction} from "./MacrosAction.jsx";
 import {getProfile, saveProfile} from "./api.js";
 import React, {useEffect, useState} from "react";
 import {Condition} from "./Contition.jsx";
+import {formatQuery} from "react-querybuilder";
 
 const INPUT_COUNT = 20;
 const onChangeBinding = (event) => {
@@ -20,16 +21,24 @@ const onChangeBinding = (event) => {
     return false;
 }
 
-const renderItems = ({Items: items = []}, conditions, setConditions) => {
+// the last edited of the expression and the query builder of an item is saved, the other one is dropped
+const onQueryEdited = (i, data, edits) => {
+    const key = formatQuery(data, 'json_without_ids');
+    if (edits.queryKeys[i] === undefined) {
+        edits.queryKeys[i] = key;
+        return;
+    }
+    if (edits.queryKeys[i] !== key) {
+        edits.queryKeys[i] = key;
+        edits.sources[i] = 'query';
+        document.getElementsByName('expression[]')[i].value = '';
+    }
+}
+
+const renderItems = ({Items: items = []}, conditions, setConditions, edits) => {
     const result = []
     for (let i = 0; i < INPUT_COUNT; i++) {
-        let preparedConditions = {rules: []};
-        if (items.length && items[i] && (items[i]?.conditions_combinator || '') !== '') {
-            preparedConditions.rules = items[i]['Conditions'].flatMap((item, index) => index < items[i]['Conditions'].length - 1 ? [item, items[i]?.conditions_combinator] : [item]);
-            // preparedConditions.rules = items[i]['Conditions'];
-        } else {
-            preparedConditions.rules = !items.length ? [] : items[i]?.Conditions || []
-        }
+        const preparedConditions = (items.length && items[i]?.query) || {combinator: 'AND', rules: []};
         result.push(<Box sx={{display: 'flex', gap: 2, m: 2}} key={i}>
             <MacrosAction name={'actions[]'} initValue={!items.length ? '' : items[i]?.Action || ''}/>
             <TextField variant={"outlined"} name={'bindings[]'} label="Binding"
@@ -44,12 +53,34 @@ const renderItems = ({Items: items = []}, conditions, setConditions) => {
                        slotProps={{inputLabel: {shrink: true}}}
                        defaultValue={!items.length ? '' : items[i]?.delay_milliseconds}
             />
+            <TextField variant={"outlined"} name={'hold_milliseconds[]'} label={"Hold"}
+                       slotProps={{inputLabel: {shrink: true}}}
+                       defaultValue={!items.length ? '' : items[i]?.hold_milliseconds}
+            />
+            <TextField variant={"outlined"} name={'hold_until[]'} label={"Hold until"}
+                       slotProps={{inputLabel: {shrink: true}}}
+                       placeholder={'target_hp = 0'}
+                       defaultValue={!items.length ? '' : items[i]?.hold_until}
+            />
+            <TextField variant={"outlined"} name={'priority[]'} label={"Priority"}
+                       slotProps={{inputLabel: {shrink: true}}}
+                       defaultValue={!items.length ? '' : items[i]?.priority}
+            />
             <TextField variant={"outlined"} name={'additional[]'} label={"Additional"}
                        slotProps={{inputLabel: {shrink: true}}}
                        defaultValue={!items.length ? '' : items[i]?.Additional}
             />
+            <TextField variant={"outlined"} name={'expression[]'} label={"Expression"}
+                       slotProps={{inputLabel: {shrink: true}}}
+                       placeholder={'my_mp < 20 UNTIL > 90'}
+                       defaultValue={!items.length ? '' : items[i]?.expression}
+                       onChange={() => {
+                           edits.sources[i] = 'expression';
+                       }}
+            />
             <Condition conditions={preparedConditions} fullWidth={true}
                        onQueryChange={(data) => {
+                           onQueryEdited(i, data, edits);
                            conditions[i] = data;
                            setConditions(conditions);
                        }} idx={i}/>
@@ -63,21 +94,28 @@ export const Macros = ({profileName}) => {
     const [formItemsData, setFormItemsData] = useState([]);
     const [formItems, setFormItems] = useState([]);
     const [conditions, setConditions] = useState([]);
+    const [edits] = useState({queryKeys: [], sources: []});
+    // the control device the profile is written for, its resolution bounds the mouse coordinates
+    const [device, setDevice] = useState('');
     // useEffect(() => {
     //     setFormItems(renderItems(formItemsData, setConditions));
     // }, [formItemsData, setConditions]);
     useEffect(() => {
         async function initProfile() {
+            edits.queryKeys.length = 0;
+            edits.sources.length = 0;
+            setDevice('');
             try {
                 const data = await getProfile(profileName);
                 if (data) {
+                    setDevice(data.device || '');
                     setFormItemsData(data);
-                    setFormItems(renderItems(data, conditions, setConditions));
+                    setFormItems(renderItems(data, conditions, setConditions, edits));
                 } else {
-                    setFormItems(renderItems([], conditions, setConditions));
+                    setFormItems(renderItems([], conditions, setConditions, edits));
                 }
             } catch (error) {
-                setFormItems(renderItems([], conditions, setConditions));
+                setFormItems(renderItems([], conditions, setConditions, edits));
             }
         }
 
@@ -86,16 +124,19 @@ export const Macros = ({profileName}) => {
     const handleSubmit = async (e) => {
         e.preventDefault();
         const formData = new FormData(e.target);
-        const obj = {items: [], profile: profileName};
+        const obj = {items: [], profile: profileName, device: device};
         for (let i = 0; i < INPUT_COUNT; i++) {
             obj.items.push({
                 'action': formData.getAll('actions[]')[i],
                 'binding': formData.getAll('bindings[]')[i],
                 'delay_milliseconds': parseInt(formData.getAll('delay_milliseconds[]')[i]),
                 'period_milliseconds': parseInt(formData.getAll('period_milliseconds[]')[i]),
+                'hold_milliseconds': parseInt(formData.getAll('hold_milliseconds[]')[i]),
+                'hold_until': formData.getAll('hold_until[]')[i],
+                'priority': parseInt(formData.getAll('priority[]')[i]),
                 'additional': formData.getAll('additional[]')[i],
-                'conditions': conditions[i].filter(item => typeof item === 'object'),
-                'conditions_combinator': conditions[i].filter(item => typeof item === 'string')[0] || "",
+                'query': edits.sources[i] === 'expression' ? null : conditions[i],
+                'expression': formData.getAll('expression[]')[i],
             })
         }
 
@@ -105,6 +146,11 @@ export const Macros = ({profileName}) => {
     }
     return (<Box>
         <form onSubmit={handleSubmit}>
+            <TextField variant={"outlined"} label={"Device"} sx={{m: 2}}
+                       slotProps={{inputLabel: {shrink: true}}}
+                       placeholder={'default'} value={device}
+                       onChange={(event) => setDevice(event.target.value)}
+            />
             {formItems}
             <ButtonGroup variant="contained" sx={{gap: 4, display: 'flex', justifyContent: 'center'}}>
                 <Button type={"submit"} disabled={submitDisabled}>Save</Button>
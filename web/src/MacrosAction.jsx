@@ -13,6 +13,10 @@ const rawActions = [
     '/aitargetnext',
     '/stop',
     '/unstuck',
+    '/drag',
+    '/scroll',
+    '/rotatecamera',
+    '/replay',
 ];
 export const MacrosAction = ({name, initValue}) => {
     const [value, setValue] = useState(null);
@@ -30,6 +30,10 @@ export const init = () => {
     return api.get('/init');
 }
 
+export const getStatus = () => {
+    return api.get('/status');
+}
+
 export const pauseMacros = (pid) => {
     return api.post('/pause', {pid}).then((response) => {
     })